@@ -83,33 +83,81 @@ func (q *Queries) GetArticlesUpdatedSince(ctx context.Context, arg GetArticlesUp
 	return items, nil
 }
 
-const insertArticle = `-- name: InsertArticle :one
+const insertArticles = `-- name: InsertArticles :execrows
 INSERT INTO articles (user_db_id, identifier, read_time, updated_at)
-VALUES ($1, $2, $3, $4)
-RETURNING db_id, read_time, identifier, user_db_id, updated_at
+SELECT $1::bigint, unnest($2::text[]), $3::timestamptz, $3::timestamptz
+ON CONFLICT (user_db_id, identifier) DO NOTHING
 `
 
-type InsertArticleParams struct {
-	UserDbID   int64
-	Identifier string
-	ReadTime   pgtype.Timestamptz
-	UpdatedAt  pgtype.Timestamptz
+type InsertArticlesParams struct {
+	UserDbID    int64
+	Identifiers []string
+	ReadTime    pgtype.Timestamptz
 }
 
-func (q *Queries) InsertArticle(ctx context.Context, arg InsertArticleParams) (Article, error) {
-	row := q.db.QueryRow(ctx, insertArticle,
-		arg.UserDbID,
-		arg.Identifier,
-		arg.ReadTime,
-		arg.UpdatedAt,
-	)
-	var i Article
-	err := row.Scan(
-		&i.DbID,
-		&i.ReadTime,
-		&i.Identifier,
-		&i.UserDbID,
-		&i.UpdatedAt,
-	)
-	return i, err
+func (q *Queries) InsertArticles(ctx context.Context, arg InsertArticlesParams) (int64, error) {
+	result, err := q.db.Exec(ctx, insertArticles, arg.UserDbID, arg.Identifiers, arg.ReadTime)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const moveArticles = `-- name: MoveArticles :execrows
+WITH moved AS (
+    DELETE FROM articles
+    WHERE user_db_id = $1
+    RETURNING identifier, read_time
+)
+INSERT INTO articles (user_db_id, identifier, read_time, updated_at)
+SELECT $2::bigint, identifier, read_time, $3::timestamptz
+FROM moved
+ON CONFLICT (user_db_id, identifier) DO NOTHING
+`
+
+type MoveArticlesParams struct {
+	SourceUserDbID int64
+	TargetUserDbID int64
+	UpdatedAt      pgtype.Timestamptz
+}
+
+func (q *Queries) MoveArticles(ctx context.Context, arg MoveArticlesParams) (int64, error) {
+	result, err := q.db.Exec(ctx, moveArticles, arg.SourceUserDbID, arg.TargetUserDbID, arg.UpdatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const pruneArticlesReadBefore = `-- name: PruneArticlesReadBefore :one
+WITH deleted AS (
+    DELETE FROM articles
+    WHERE db_id IN (
+        SELECT db_id
+        FROM articles
+        WHERE read_time < $1
+        ORDER BY read_time
+        LIMIT $2
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING user_db_id
+), marked AS (
+    UPDATE users
+    SET readmarks_pruned_before = $1
+    WHERE db_id IN (SELECT DISTINCT user_db_id FROM deleted)
+    AND (readmarks_pruned_before IS NULL OR readmarks_pruned_before < $1)
+)
+SELECT count(*) FROM deleted
+`
+
+type PruneArticlesReadBeforeParams struct {
+	ReadTime pgtype.Timestamptz
+	Limit    int32
+}
+
+func (q *Queries) PruneArticlesReadBefore(ctx context.Context, arg PruneArticlesReadBeforeParams) (int64, error) {
+	row := q.db.QueryRow(ctx, pruneArticlesReadBefore, arg.ReadTime, arg.Limit)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
 }
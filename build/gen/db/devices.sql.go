@@ -11,6 +11,93 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const authenticateDevice = `-- name: AuthenticateDevice :one
+WITH found_user AS (
+    SELECT db_id, user_id, legacy_sync_code, readmarks_pruned_before
+    FROM users
+    WHERE users.user_id = $1
+    OR users.db_id = (SELECT user_db_id FROM user_id_aliases WHERE user_id_aliases.user_id = $1)
+    OR users.legacy_sync_code = $2
+    OR users.db_id = (SELECT user_db_id FROM sync_code_aliases WHERE sync_code_aliases.legacy_sync_code = $2)
+    LIMIT 1
+)
+SELECT
+    found_user.db_id,
+    found_user.user_id,
+    found_user.legacy_sync_code,
+    found_user.readmarks_pruned_before,
+    devices.db_id AS device_db_id,
+    devices.device_id,
+    devices.legacy_device_id,
+    devices.device_name,
+    devices.last_seen,
+    devices.push_endpoint,
+    devices.platform,
+    devices.app_version,
+    devices.registered_at
+FROM found_user
+LEFT JOIN devices ON devices.user_db_id = found_user.db_id AND devices.legacy_device_id = $3
+`
+
+type AuthenticateDeviceParams struct {
+	UserID         pgtype.Text
+	SyncCode       pgtype.Text
+	LegacyDeviceID int64
+}
+
+type AuthenticateDeviceRow struct {
+	DbID                  int64
+	UserID                string
+	LegacySyncCode        string
+	ReadmarksPrunedBefore pgtype.Timestamptz
+	DeviceDbID            pgtype.Int8
+	DeviceID              pgtype.Text
+	LegacyDeviceID        pgtype.Int8
+	DeviceName            pgtype.Text
+	LastSeen              pgtype.Timestamptz
+	PushEndpoint          pgtype.Text
+	Platform              pgtype.Text
+	AppVersion            pgtype.Text
+	RegisteredAt          pgtype.Timestamptz
+}
+
+func (q *Queries) AuthenticateDevice(ctx context.Context, arg AuthenticateDeviceParams) (AuthenticateDeviceRow, error) {
+	row := q.db.QueryRow(ctx, authenticateDevice, arg.UserID, arg.SyncCode, arg.LegacyDeviceID)
+	var i AuthenticateDeviceRow
+	err := row.Scan(
+		&i.DbID,
+		&i.UserID,
+		&i.LegacySyncCode,
+		&i.ReadmarksPrunedBefore,
+		&i.DeviceDbID,
+		&i.DeviceID,
+		&i.LegacyDeviceID,
+		&i.DeviceName,
+		&i.LastSeen,
+		&i.PushEndpoint,
+		&i.Platform,
+		&i.AppVersion,
+		&i.RegisteredAt,
+	)
+	return i, err
+}
+
+const clearPushEndpoint = `-- name: ClearPushEndpoint :exec
+UPDATE devices
+SET push_endpoint = NULL
+WHERE db_id = $1 AND push_endpoint = $2
+`
+
+type ClearPushEndpointParams struct {
+	DbID         int64
+	PushEndpoint pgtype.Text
+}
+
+func (q *Queries) ClearPushEndpoint(ctx context.Context, arg ClearPushEndpointParams) error {
+	_, err := q.db.Exec(ctx, clearPushEndpoint, arg.DbID, arg.PushEndpoint)
+	return err
+}
+
 const deleteDevice = `-- name: DeleteDevice :many
 DELETE FROM devices
 WHERE user_db_id = $1 AND device_id = $2
@@ -73,8 +160,46 @@ func (q *Queries) DeleteDeviceWithLegacyId(ctx context.Context, arg DeleteDevice
 	return items, nil
 }
 
+const deleteDevicesNotSeenSince = `-- name: DeleteDevicesNotSeenSince :many
+DELETE FROM devices
+WHERE db_id IN (
+    SELECT db_id
+    FROM devices
+    WHERE last_seen < $1
+    ORDER BY last_seen
+    LIMIT $2
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING user_db_id
+`
+
+type DeleteDevicesNotSeenSinceParams struct {
+	LastSeen pgtype.Timestamptz
+	Limit    int32
+}
+
+func (q *Queries) DeleteDevicesNotSeenSince(ctx context.Context, arg DeleteDevicesNotSeenSinceParams) ([]int64, error) {
+	rows, err := q.db.Query(ctx, deleteDevicesNotSeenSince, arg.LastSeen, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var user_db_id int64
+		if err := rows.Scan(&user_db_id); err != nil {
+			return nil, err
+		}
+		items = append(items, user_db_id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getAllDevices = `-- name: GetAllDevices :many
-SELECT db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id FROM devices
+SELECT db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id, push_endpoint, platform, app_version, registered_at FROM devices
 `
 
 func (q *Queries) GetAllDevices(ctx context.Context) ([]Device, error) {
@@ -93,6 +218,10 @@ func (q *Queries) GetAllDevices(ctx context.Context) ([]Device, error) {
 			&i.DeviceName,
 			&i.LastSeen,
 			&i.UserDbID,
+			&i.PushEndpoint,
+			&i.Platform,
+			&i.AppVersion,
+			&i.RegisteredAt,
 		); err != nil {
 			return nil, err
 		}
@@ -106,7 +235,7 @@ func (q *Queries) GetAllDevices(ctx context.Context) ([]Device, error) {
 
 const getDevices = `-- name: GetDevices :many
 SELECT
-    db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id
+    db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id, push_endpoint, platform, app_version, registered_at
 FROM devices
 WHERE user_db_id = $1
 `
@@ -127,6 +256,10 @@ func (q *Queries) GetDevices(ctx context.Context, userDbID int64) ([]Device, err
 			&i.DeviceName,
 			&i.LastSeen,
 			&i.UserDbID,
+			&i.PushEndpoint,
+			&i.Platform,
+			&i.AppVersion,
+			&i.RegisteredAt,
 		); err != nil {
 			return nil, err
 		}
@@ -138,9 +271,40 @@ func (q *Queries) GetDevices(ctx context.Context, userDbID int64) ([]Device, err
 	return items, nil
 }
 
+const getDevicesEtag = `-- name: GetDevicesEtag :one
+SELECT
+    sha256(convert_to(coalesce(string_agg(
+        concat_ws(
+            E'\x1f',
+            legacy_device_id::text,
+            device_id,
+            device_name,
+            platform,
+            app_version,
+            coalesce((extract(epoch FROM registered_at) * 1000)::bigint::text, ''),
+            (last_seen < $1)::text
+        ),
+        E'\x1e' ORDER BY legacy_device_id
+    ), ''), 'UTF8'))::bytea AS etag
+FROM devices
+WHERE user_db_id = $2
+`
+
+type GetDevicesEtagParams struct {
+	StaleBefore pgtype.Timestamptz
+	UserDbID    int64
+}
+
+func (q *Queries) GetDevicesEtag(ctx context.Context, arg GetDevicesEtagParams) ([]byte, error) {
+	row := q.db.QueryRow(ctx, getDevicesEtag, arg.StaleBefore, arg.UserDbID)
+	var etag []byte
+	err := row.Scan(&etag)
+	return etag, err
+}
+
 const getLegacyDevice = `-- name: GetLegacyDevice :one
 SELECT
-    db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id
+    db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id, push_endpoint, platform, app_version, registered_at
 FROM devices
 WHERE user_db_id = $1 AND legacy_device_id = $2
 LIMIT 1
@@ -161,23 +325,50 @@ func (q *Queries) GetLegacyDevice(ctx context.Context, arg GetLegacyDeviceParams
 		&i.DeviceName,
 		&i.LastSeen,
 		&i.UserDbID,
+		&i.PushEndpoint,
+		&i.Platform,
+		&i.AppVersion,
+		&i.RegisteredAt,
 	)
 	return i, err
 }
 
-const getLegacyDevicesEtag = `-- name: GetLegacyDevicesEtag :one
+const getPushEndpoints = `-- name: GetPushEndpoints :many
 SELECT
-    sha256(convert_to(string_agg(device_name, '' ORDER BY device_name), 'UTF8'))
+    db_id,
+    push_endpoint::text AS push_endpoint
 FROM devices
-WHERE user_db_id = $1
-GROUP BY user_db_id
+WHERE user_db_id = $1 AND db_id <> $2 AND push_endpoint IS NOT NULL
 `
 
-func (q *Queries) GetLegacyDevicesEtag(ctx context.Context, userDbID int64) ([]byte, error) {
-	row := q.db.QueryRow(ctx, getLegacyDevicesEtag, userDbID)
-	var sha256 []byte
-	err := row.Scan(&sha256)
-	return sha256, err
+type GetPushEndpointsParams struct {
+	UserDbID int64
+	DbID     int64
+}
+
+type GetPushEndpointsRow struct {
+	DbID         int64
+	PushEndpoint string
+}
+
+func (q *Queries) GetPushEndpoints(ctx context.Context, arg GetPushEndpointsParams) ([]GetPushEndpointsRow, error) {
+	rows, err := q.db.Query(ctx, getPushEndpoints, arg.UserDbID, arg.DbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetPushEndpointsRow
+	for rows.Next() {
+		var i GetPushEndpointsRow
+		if err := rows.Scan(&i.DbID, &i.PushEndpoint); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
 const insertDevice = `-- name: InsertDevice :one
@@ -185,7 +376,7 @@ INSERT INTO devices (
     device_id, device_name, last_seen, legacy_device_id, user_db_id
 )
 VALUES ($1, $2, $3, $4, $5)
-RETURNING db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id
+RETURNING db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id, push_endpoint, platform, app_version, registered_at
 `
 
 type InsertDeviceParams struct {
@@ -212,22 +403,105 @@ func (q *Queries) InsertDevice(ctx context.Context, arg InsertDeviceParams) (Dev
 		&i.DeviceName,
 		&i.LastSeen,
 		&i.UserDbID,
+		&i.PushEndpoint,
+		&i.Platform,
+		&i.AppVersion,
+		&i.RegisteredAt,
+	)
+	return i, err
+}
+
+const moveDevices = `-- name: MoveDevices :execrows
+UPDATE devices
+SET user_db_id = $1
+WHERE user_db_id = $2
+`
+
+type MoveDevicesParams struct {
+	TargetUserDbID int64
+	SourceUserDbID int64
+}
+
+func (q *Queries) MoveDevices(ctx context.Context, arg MoveDevicesParams) (int64, error) {
+	result, err := q.db.Exec(ctx, moveDevices, arg.TargetUserDbID, arg.SourceUserDbID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const updateDevice = `-- name: UpdateDevice :one
+UPDATE devices
+SET
+    device_name = coalesce($1, device_name),
+    platform = coalesce($2, platform),
+    app_version = coalesce($3, app_version)
+WHERE user_db_id = $4 AND device_id = $5
+RETURNING db_id, device_id, legacy_device_id, device_name, last_seen, user_db_id, push_endpoint, platform, app_version, registered_at
+`
+
+type UpdateDeviceParams struct {
+	DeviceName pgtype.Text
+	Platform   pgtype.Text
+	AppVersion pgtype.Text
+	UserDbID   int64
+	DeviceID   string
+}
+
+func (q *Queries) UpdateDevice(ctx context.Context, arg UpdateDeviceParams) (Device, error) {
+	row := q.db.QueryRow(ctx, updateDevice,
+		arg.DeviceName,
+		arg.Platform,
+		arg.AppVersion,
+		arg.UserDbID,
+		arg.DeviceID,
+	)
+	var i Device
+	err := row.Scan(
+		&i.DbID,
+		&i.DeviceID,
+		&i.LegacyDeviceID,
+		&i.DeviceName,
+		&i.LastSeen,
+		&i.UserDbID,
+		&i.PushEndpoint,
+		&i.Platform,
+		&i.AppVersion,
+		&i.RegisteredAt,
 	)
 	return i, err
 }
 
-const updateLastSeenForDevice = `-- name: UpdateLastSeenForDevice :exec
+const updateLastSeenForDevices = `-- name: UpdateLastSeenForDevices :exec
+UPDATE devices
+SET last_seen = seen.last_seen
+FROM unnest($1::bigint[], $2::timestamptz[]) AS seen(db_id, last_seen)
+WHERE devices.db_id = seen.db_id
+AND devices.last_seen < seen.last_seen
+`
+
+type UpdateLastSeenForDevicesParams struct {
+	DbIds    []int64
+	LastSeen []pgtype.Timestamptz
+}
+
+func (q *Queries) UpdateLastSeenForDevices(ctx context.Context, arg UpdateLastSeenForDevicesParams) error {
+	_, err := q.db.Exec(ctx, updateLastSeenForDevices, arg.DbIds, arg.LastSeen)
+	return err
+}
+
+const updatePushEndpoint = `-- name: UpdatePushEndpoint :exec
 UPDATE devices
-SET last_seen = $1
+SET push_endpoint = $1
 WHERE db_id = $2
 `
 
-type UpdateLastSeenForDeviceParams struct {
-	LastSeen pgtype.Timestamptz
-	DbID     int64
+type UpdatePushEndpointParams struct {
+	PushEndpoint pgtype.Text
+	DbID         int64
 }
 
-func (q *Queries) UpdateLastSeenForDevice(ctx context.Context, arg UpdateLastSeenForDeviceParams) error {
-	_, err := q.db.Exec(ctx, updateLastSeenForDevice, arg.LastSeen, arg.DbID)
+func (q *Queries) UpdatePushEndpoint(ctx context.Context, arg UpdatePushEndpointParams) error {
+	_, err := q.db.Exec(ctx, updatePushEndpoint, arg.PushEndpoint, arg.DbID)
 	return err
 }
@@ -9,6 +9,47 @@ import (
 	"context"
 )
 
+const adoptLegacyFeeds = `-- name: AdoptLegacyFeeds :execrows
+UPDATE legacy_feeds
+SET user_db_id = $1
+WHERE user_db_id = $2
+AND NOT EXISTS (SELECT 1 FROM legacy_feeds WHERE user_db_id = $1)
+`
+
+type AdoptLegacyFeedsParams struct {
+	TargetUserDbID int64
+	SourceUserDbID int64
+}
+
+func (q *Queries) AdoptLegacyFeeds(ctx context.Context, arg AdoptLegacyFeedsParams) (int64, error) {
+	result, err := q.db.Exec(ctx, adoptLegacyFeeds, arg.TargetUserDbID, arg.SourceUserDbID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const archiveLegacyFeeds = `-- name: ArchiveLegacyFeeds :execrows
+INSERT INTO legacy_feeds_versions (user_db_id, content_hash, content, etag)
+SELECT $1::bigint, content_hash, content, etag
+FROM legacy_feeds
+WHERE user_db_id = $1 OR user_db_id = $2
+ORDER BY user_db_id = $1
+`
+
+type ArchiveLegacyFeedsParams struct {
+	TargetUserDbID int64
+	SourceUserDbID int64
+}
+
+func (q *Queries) ArchiveLegacyFeeds(ctx context.Context, arg ArchiveLegacyFeedsParams) (int64, error) {
+	result, err := q.db.Exec(ctx, archiveLegacyFeeds, arg.TargetUserDbID, arg.SourceUserDbID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const getAllLegacyFeeds = `-- name: GetAllLegacyFeeds :many
 SELECT
     db_id, content_hash, content, etag, user_db_id
@@ -76,6 +117,94 @@ func (q *Queries) GetLegacyFeedsEtag(ctx context.Context, userDbID int64) (strin
 	return etag, err
 }
 
+const getLegacyFeedsVersions = `-- name: GetLegacyFeedsVersions :many
+SELECT
+    db_id, content_hash, content, etag, created_at, user_db_id
+FROM legacy_feeds_versions
+WHERE user_db_id = $1
+ORDER BY created_at DESC, db_id DESC
+`
+
+func (q *Queries) GetLegacyFeedsVersions(ctx context.Context, userDbID int64) ([]LegacyFeedsVersion, error) {
+	rows, err := q.db.Query(ctx, getLegacyFeedsVersions, userDbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []LegacyFeedsVersion
+	for rows.Next() {
+		var i LegacyFeedsVersion
+		if err := rows.Scan(
+			&i.DbID,
+			&i.ContentHash,
+			&i.Content,
+			&i.Etag,
+			&i.CreatedAt,
+			&i.UserDbID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const moveLegacyFeedsVersions = `-- name: MoveLegacyFeedsVersions :exec
+UPDATE legacy_feeds_versions
+SET user_db_id = $1
+WHERE user_db_id = $2
+`
+
+type MoveLegacyFeedsVersionsParams struct {
+	TargetUserDbID int64
+	SourceUserDbID int64
+}
+
+func (q *Queries) MoveLegacyFeedsVersions(ctx context.Context, arg MoveLegacyFeedsVersionsParams) error {
+	_, err := q.db.Exec(ctx, moveLegacyFeedsVersions, arg.TargetUserDbID, arg.SourceUserDbID)
+	return err
+}
+
+const pruneLegacyFeedsVersions = `-- name: PruneLegacyFeedsVersions :execrows
+WITH ranked AS (
+    SELECT
+        db_id,
+        row_number() OVER newest_first AS newness,
+        sum(octet_length(content)) OVER newest_first AS cumulative_bytes
+    FROM legacy_feeds_versions
+    WHERE user_db_id = $1
+    WINDOW newest_first AS (ORDER BY created_at DESC, db_id DESC)
+), current_feeds AS (
+    SELECT coalesce(sum(octet_length(content)), 0) AS bytes
+    FROM legacy_feeds
+    WHERE user_db_id = $1
+)
+DELETE FROM legacy_feeds_versions
+WHERE db_id IN (
+    SELECT ranked.db_id
+    FROM ranked, current_feeds
+    WHERE ($2::int > 0 AND ranked.newness > $2::int)
+    OR ($3::bigint > 0 AND ranked.cumulative_bytes + current_feeds.bytes > $3::bigint)
+)
+`
+
+type PruneLegacyFeedsVersionsParams struct {
+	UserDbID    int64
+	MaxVersions int32
+	MaxBytes    int64
+}
+
+func (q *Queries) PruneLegacyFeedsVersions(ctx context.Context, arg PruneLegacyFeedsVersionsParams) (int64, error) {
+	result, err := q.db.Exec(ctx, pruneLegacyFeedsVersions, arg.UserDbID, arg.MaxVersions, arg.MaxBytes)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const updateLegacyFeeds = `-- name: UpdateLegacyFeeds :one
 INSERT INTO legacy_feeds (user_db_id, content_hash, content, etag)
 VALUES ($1, $2, $3, $4)
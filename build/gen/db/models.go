@@ -23,6 +23,10 @@ type Device struct {
 	DeviceName     string
 	LastSeen       pgtype.Timestamptz
 	UserDbID       int64
+	PushEndpoint   pgtype.Text
+	Platform       string
+	AppVersion     string
+	RegisteredAt   pgtype.Timestamptz
 }
 
 type LegacyFeed struct {
@@ -33,8 +37,28 @@ type LegacyFeed struct {
 	UserDbID    int64
 }
 
-type User struct {
-	DbID           int64
-	UserID         string
+type LegacyFeedsVersion struct {
+	DbID        int64
+	ContentHash int64
+	Content     string
+	Etag        string
+	CreatedAt   pgtype.Timestamptz
+	UserDbID    int64
+}
+
+type SyncCodeAlias struct {
 	LegacySyncCode string
+	UserDbID       int64
+}
+
+type User struct {
+	DbID                  int64
+	UserID                string
+	LegacySyncCode        string
+	ReadmarksPrunedBefore pgtype.Timestamptz
+}
+
+type UserIDAlias struct {
+	UserID   string
+	UserDbID int64
 }
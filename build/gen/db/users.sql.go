@@ -9,6 +9,34 @@ import (
 	"context"
 )
 
+const deleteUsersWithoutDevices = `-- name: DeleteUsersWithoutDevices :execrows
+WITH orphans AS (
+    SELECT db_id
+    FROM users
+    WHERE db_id = ANY($1::bigint[])
+    AND NOT EXISTS (SELECT 1 FROM devices WHERE devices.user_db_id = users.db_id)
+), deleted_articles AS (
+    DELETE FROM articles WHERE user_db_id IN (SELECT db_id FROM orphans)
+), deleted_feeds AS (
+    DELETE FROM legacy_feeds WHERE user_db_id IN (SELECT db_id FROM orphans)
+), deleted_feeds_versions AS (
+    DELETE FROM legacy_feeds_versions WHERE user_db_id IN (SELECT db_id FROM orphans)
+), deleted_aliases AS (
+    DELETE FROM sync_code_aliases WHERE user_db_id IN (SELECT db_id FROM orphans)
+), deleted_user_id_aliases AS (
+    DELETE FROM user_id_aliases WHERE user_db_id IN (SELECT db_id FROM orphans)
+)
+DELETE FROM users WHERE db_id IN (SELECT db_id FROM orphans)
+`
+
+func (q *Queries) DeleteUsersWithoutDevices(ctx context.Context, userDbIds []int64) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteUsersWithoutDevices, userDbIds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const getAllUsers = `-- name: GetAllUsers :many
 SELECT
     db_id,
@@ -42,24 +70,40 @@ func (q *Queries) GetAllUsers(ctx context.Context) ([]GetAllUsersRow, error) {
 }
 
 const getUserBySyncCode = `-- name: GetUserBySyncCode :one
-SELECT db_id, user_id, legacy_sync_code FROM users WHERE legacy_sync_code = $1 LIMIT 1
+SELECT db_id, user_id, legacy_sync_code, readmarks_pruned_before FROM users
+WHERE legacy_sync_code = $1
+OR db_id = (SELECT user_db_id FROM sync_code_aliases WHERE sync_code_aliases.legacy_sync_code = $1)
+LIMIT 1
 `
 
 func (q *Queries) GetUserBySyncCode(ctx context.Context, legacySyncCode string) (User, error) {
 	row := q.db.QueryRow(ctx, getUserBySyncCode, legacySyncCode)
 	var i User
-	err := row.Scan(&i.DbID, &i.UserID, &i.LegacySyncCode)
+	err := row.Scan(
+		&i.DbID,
+		&i.UserID,
+		&i.LegacySyncCode,
+		&i.ReadmarksPrunedBefore,
+	)
 	return i, err
 }
 
 const getUserByUserId = `-- name: GetUserByUserId :one
-SELECT db_id, user_id, legacy_sync_code FROM users WHERE user_id = $1 LIMIT 1
+SELECT db_id, user_id, legacy_sync_code, readmarks_pruned_before FROM users
+WHERE user_id = $1
+OR db_id = (SELECT user_db_id FROM user_id_aliases WHERE user_id_aliases.user_id = $1)
+LIMIT 1
 `
 
 func (q *Queries) GetUserByUserId(ctx context.Context, userID string) (User, error) {
 	row := q.db.QueryRow(ctx, getUserByUserId, userID)
 	var i User
-	err := row.Scan(&i.DbID, &i.UserID, &i.LegacySyncCode)
+	err := row.Scan(
+		&i.DbID,
+		&i.UserID,
+		&i.LegacySyncCode,
+		&i.ReadmarksPrunedBefore,
+	)
 	return i, err
 }
 
@@ -85,10 +129,60 @@ func (q *Queries) GetUserDbIdBySyncCode(ctx context.Context, legacySyncCode stri
 	return db_id, err
 }
 
+const getUserUsage = `-- name: GetUserUsage :one
+SELECT
+    (SELECT count(*) FROM articles WHERE articles.user_db_id = $1)::bigint AS read_marks,
+    (SELECT count(*) FROM devices WHERE devices.user_db_id = $1)::bigint AS devices,
+    (
+        (SELECT coalesce(sum(octet_length(content)), 0) FROM legacy_feeds WHERE legacy_feeds.user_db_id = $1)
+        + (SELECT coalesce(sum(octet_length(content)), 0) FROM legacy_feeds_versions WHERE legacy_feeds_versions.user_db_id = $1)
+    )::bigint AS feeds_bytes
+`
+
+type GetUserUsageRow struct {
+	ReadMarks  int64
+	Devices    int64
+	FeedsBytes int64
+}
+
+func (q *Queries) GetUserUsage(ctx context.Context, userDbID int64) (GetUserUsageRow, error) {
+	row := q.db.QueryRow(ctx, getUserUsage, userDbID)
+	var i GetUserUsageRow
+	err := row.Scan(&i.ReadMarks, &i.Devices, &i.FeedsBytes)
+	return i, err
+}
+
+const getUsersWithoutDevices = `-- name: GetUsersWithoutDevices :many
+SELECT db_id
+FROM users
+WHERE NOT EXISTS (SELECT 1 FROM devices WHERE devices.user_db_id = users.db_id)
+LIMIT $1
+`
+
+func (q *Queries) GetUsersWithoutDevices(ctx context.Context, limit int32) ([]int64, error) {
+	rows, err := q.db.Query(ctx, getUsersWithoutDevices, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var db_id int64
+		if err := rows.Scan(&db_id); err != nil {
+			return nil, err
+		}
+		items = append(items, db_id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const insertUser = `-- name: InsertUser :one
 INSERT INTO users (user_id, legacy_sync_code)
 VALUES ($1, $2)
-RETURNING db_id, user_id, legacy_sync_code
+RETURNING db_id, user_id, legacy_sync_code, readmarks_pruned_before
 `
 
 type InsertUserParams struct {
@@ -99,6 +193,83 @@ type InsertUserParams struct {
 func (q *Queries) InsertUser(ctx context.Context, arg InsertUserParams) (User, error) {
 	row := q.db.QueryRow(ctx, insertUser, arg.UserID, arg.LegacySyncCode)
 	var i User
-	err := row.Scan(&i.DbID, &i.UserID, &i.LegacySyncCode)
+	err := row.Scan(
+		&i.DbID,
+		&i.UserID,
+		&i.LegacySyncCode,
+		&i.ReadmarksPrunedBefore,
+	)
 	return i, err
 }
+
+const lockUsers = `-- name: LockUsers :many
+SELECT db_id
+FROM users
+WHERE db_id = ANY($1::bigint[])
+ORDER BY db_id
+FOR UPDATE
+`
+
+func (q *Queries) LockUsers(ctx context.Context, userDbIds []int64) ([]int64, error) {
+	rows, err := q.db.Query(ctx, lockUsers, userDbIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var db_id int64
+		if err := rows.Scan(&db_id); err != nil {
+			return nil, err
+		}
+		items = append(items, db_id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const mergeSyncCodeAliases = `-- name: MergeSyncCodeAliases :exec
+WITH moved AS (
+    UPDATE sync_code_aliases
+    SET user_db_id = $1
+    WHERE user_db_id = $2
+)
+INSERT INTO sync_code_aliases (legacy_sync_code, user_db_id)
+SELECT legacy_sync_code, $1::bigint
+FROM users
+WHERE db_id = $2
+`
+
+type MergeSyncCodeAliasesParams struct {
+	TargetUserDbID int64
+	SourceUserDbID int64
+}
+
+func (q *Queries) MergeSyncCodeAliases(ctx context.Context, arg MergeSyncCodeAliasesParams) error {
+	_, err := q.db.Exec(ctx, mergeSyncCodeAliases, arg.TargetUserDbID, arg.SourceUserDbID)
+	return err
+}
+
+const mergeUserIdAliases = `-- name: MergeUserIdAliases :exec
+WITH moved AS (
+    UPDATE user_id_aliases
+    SET user_db_id = $1
+    WHERE user_db_id = $2
+)
+INSERT INTO user_id_aliases (user_id, user_db_id)
+SELECT user_id, $1::bigint
+FROM users
+WHERE db_id = $2
+`
+
+type MergeUserIdAliasesParams struct {
+	TargetUserDbID int64
+	SourceUserDbID int64
+}
+
+func (q *Queries) MergeUserIdAliases(ctx context.Context, arg MergeUserIdAliasesParams) error {
+	_, err := q.db.Exec(ctx, mergeUserIdAliases, arg.TargetUserDbID, arg.SourceUserDbID)
+	return err
+}
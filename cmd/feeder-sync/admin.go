@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spacecowboy/feeder-sync/internal/maintenance"
+	"github.com/spacecowboy/feeder-sync/internal/metrics"
+)
+
+// Runs a single administrative action and exits
+func admin(args []string) {
+	words, flags := splitWords(args)
+	if len(words) != 1 {
+		usageError("admin needs a single action")
+	}
+	action := words[0]
+	cfg := loadConfig("admin "+action, flags)
+	ctx := context.Background()
+
+	switch action {
+	case "config":
+		cfg.Print(os.Stdout)
+	case "prune-readmarks":
+		if cfg.ReadMarkRetention <= 0 {
+			usageError("Set -readmark-retention to prune read marks")
+		}
+		repo := openRepository(cfg, nil)
+		defer repo.Close(ctx)
+
+		// The pruner logs the result. Nothing serves metrics here.
+		if _, err := maintenance.NewReadMarkPruner(repo, cfg.ReadMarkRetention, metrics.New()).PruneOnce(ctx); err != nil {
+			fatal("Failed to prune read marks", "error", err)
+		}
+	case "reap-devices":
+		if cfg.DeviceRetention <= 0 {
+			usageError("Set -device-retention to reap devices")
+		}
+		repo := openRepository(cfg, nil)
+		defer repo.Close(ctx)
+
+		// The reaper logs the result. Nothing serves metrics here.
+		if _, err := maintenance.NewDeviceReaper(repo, cfg.DeviceRetention, metrics.New()).ReapOnce(ctx); err != nil {
+			fatal("Failed to reap devices", "error", err)
+		}
+	default:
+		usageError(fmt.Sprintf("unknown admin action %q", action))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spacecowboy/feeder-sync/internal/config"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+const usage = `Usage: feeder-sync <command> [flags]
+
+Commands:
+  serve            Serve the API. With -migrate-on-start, pending migrations are applied first.
+  migrate [action] Manage the database schema, with action one of:
+                     status           Print the current and latest version
+                     up [N|all]       Apply N, by default all, pending migrations
+                     down [N|all]     Roll back N, by default 1, migrations
+                     goto V           Migrate up or down to version V
+                     force V          Set the version to V, -1 for none, without migrating.
+                                      Clears the dirty flag after fixing a failed migration by hand.
+                   Without an action, all pending migrations are applied.
+  admin <action>   Run an administrative action, one of:
+                     config           Print the effective configuration
+                     prune-readmarks  Prune read marks older than -readmark-retention now
+                     reap-devices     Delete devices not seen for -device-retention now
+
+Run "feeder-sync <command> -h" for the flags of a command.
+`
+
+func main() {
+	command, args := "", os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve(args)
+	case "migrate":
+		migrate(args)
+	case "admin":
+		admin(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// Loads and validates the config of the command, exiting on failure
+func loadConfig(command string, args []string) config.Config {
+	cfg, err := config.Load("feeder-sync "+command, args, os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		// Not logged, as the logger is configured by the config
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	slog.SetDefault(cfg.Logger(os.Stderr))
+	if cfg.LogLevel != "debug" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	return cfg
+}
+
+// Splits off the leading words naming a subcommand, and its arguments, from the flags.
+// Negative numbers, like the -1 of "force -1", are words.
+func splitWords(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if _, err := strconv.Atoi(arg); err != nil && strings.HasPrefix(arg, "-") {
+			return args[:i], args[i:]
+		}
+	}
+	return args, nil
+}
+
+// The tracer, if not nil, is called for every query
+func openRepository(cfg config.Config, tracer pgx.QueryTracer) *repository.PostgresRepository {
+	poolConfig, err := cfg.PoolConfig()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	poolConfig.ConnConfig.Tracer = tracer
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		fatal("Failed to connect to database", "error", err)
+	}
+	return repository.NewPostgresRepository(pool)
+}
+
+// Logs the failure and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spacecowboy/feeder-sync/internal/migrations"
+)
+
+// Manages the database schema. Without an action, all pending migrations are applied.
+func migrate(args []string) {
+	words, flags := splitWords(args)
+	action, operands := "up", []string(nil)
+	if len(words) > 0 {
+		action, operands = words[0], words[1:]
+	}
+	run := parseMigrateAction(action, operands)
+	cfg := loadConfig("migrate "+action, flags)
+
+	m, err := migrations.New(cfg.PostgresConn)
+	if err != nil {
+		fatal("Failed to create migrator", "error", err)
+	}
+	defer m.Close()
+
+	before, err := m.Status()
+	if err != nil {
+		fatal("Failed to read the schema version", "error", err)
+	}
+	if run == nil {
+		fmt.Printf("Schema is at %s\n", before)
+		return
+	}
+
+	err = run(m)
+	after, statusErr := m.Status()
+	if statusErr != nil {
+		fatal("Failed to read the schema version", "error", statusErr)
+	}
+	if err != nil {
+		fatal("Failed to "+action, "error", err, "schema", after.String())
+	}
+	if before == after {
+		fmt.Printf("No change, schema is at %s\n", after)
+	} else {
+		fmt.Printf("Schema was at %s\nSchema is at %s\n", before, after)
+	}
+}
+
+// Returns what the action does to the schema, or nil if it only reads the status.
+// Exits on invalid arguments.
+func parseMigrateAction(action string, operands []string) func(m *migrations.Migrator) error {
+	switch action {
+	case "status":
+		expectOperands(operands, 0)
+		return nil
+	case "up":
+		expectOperands(operands, 1)
+		steps := optionalCount(operands, 0)
+		return func(m *migrations.Migrator) error { return m.Up(steps) }
+	case "down":
+		expectOperands(operands, 1)
+		// Rolling back everything must be asked for explicitly
+		steps := optionalCount(operands, 1)
+		return func(m *migrations.Migrator) error { return m.Down(steps) }
+	case "goto":
+		expectOperands(operands, 1)
+		version, err := strconv.ParseUint(requiredOperand(operands), 10, 0)
+		if err != nil {
+			usageError("goto needs a version, like 12")
+		}
+		return func(m *migrations.Migrator) error { return m.Goto(uint(version)) }
+	case "force":
+		expectOperands(operands, 1)
+		version, err := strconv.Atoi(requiredOperand(operands))
+		if err != nil || version < -1 {
+			usageError("force needs a version, like 12, or -1 for none")
+		}
+		return func(m *migrations.Migrator) error { return m.Force(version) }
+	default:
+		usageError(fmt.Sprintf("unknown migrate action %q", action))
+		return nil
+	}
+}
+
+func expectOperands(operands []string, max int) {
+	if len(operands) > max {
+		usageError(fmt.Sprintf("unexpected argument %q", operands[max]))
+	}
+}
+
+func requiredOperand(operands []string) string {
+	if len(operands) == 0 {
+		return ""
+	}
+	return operands[0]
+}
+
+// Parses the optional count of migrations to apply. "all" is the same as 0.
+func optionalCount(operands []string, fallback int) int {
+	if len(operands) == 0 {
+		return fallback
+	}
+	if operands[0] == "all" {
+		return 0
+	}
+	count, err := strconv.Atoi(operands[0])
+	if err != nil || count <= 0 {
+		usageError(fmt.Sprintf("expected a positive number of migrations, or all, got %q", operands[0]))
+	}
+	return count
+}
+
+func usageError(message string) {
+	fmt.Fprintf(os.Stderr, "%s\n\n%s", message, usage)
+	os.Exit(2)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spacecowboy/feeder-sync/internal/events"
+	"github.com/spacecowboy/feeder-sync/internal/jobs"
+	"github.com/spacecowboy/feeder-sync/internal/maintenance"
+	"github.com/spacecowboy/feeder-sync/internal/metrics"
+	"github.com/spacecowboy/feeder-sync/internal/migrations"
+	"github.com/spacecowboy/feeder-sync/internal/push"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+	"github.com/spacecowboy/feeder-sync/internal/server"
+	"github.com/spacecowboy/feeder-sync/internal/tracing"
+)
+
+// Serves the API until interrupted
+func serve(args []string) {
+	cfg := loadConfig("serve", args)
+	slog.Info("Effective configuration", "config", cfg)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing())
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Failed to export pending spans", "error", err)
+		}
+	}()
+
+	m := metrics.New()
+	repo := openRepository(cfg, tracing.QueryTracer(m.QueryTracer()))
+
+	if cfg.MigrateOnStart {
+		if err := migrateWithLock(repo, cfg.PostgresConn); err != nil {
+			fatal("Failed to run migrations", "error", err)
+		}
+	}
+
+	scheduler := jobs.NewScheduler(repo.NewAdvisoryLock(jobs.LeaderLockKey))
+
+	if cfg.ReadMarkRetention > 0 {
+		pruner := maintenance.NewReadMarkPruner(repo, cfg.ReadMarkRetention, m)
+		scheduler.Register(
+			"prune-readmarks",
+			cfg.ReadMarkPruneInterval,
+			func(ctx context.Context) (any, error) {
+				return pruner.PruneOnce(ctx)
+			},
+		)
+	}
+
+	if cfg.DeviceRetention > 0 {
+		reaper := maintenance.NewDeviceReaper(repo, cfg.DeviceRetention, m)
+		scheduler.Register(
+			"reap-devices",
+			cfg.DeviceReapInterval,
+			func(ctx context.Context) (any, error) {
+				return reaper.ReapOnce(ctx)
+			},
+		)
+	}
+
+	broker := events.NewBroker()
+
+	// Authentication lookups are cached. Cross-instance invalidation relies on ListenForChanges below.
+	cachedRepo := repository.NewCachedRepository(repo, cfg.CacheSize, cfg.CacheTTL)
+
+	router, err := server.NewServerWithRepo(
+		cachedRepo,
+		server.WithBroker(broker),
+		server.WithLimits(cfg.Limits()),
+		server.WithDeviceStaleAfter(cfg.DeviceStaleAfter),
+		server.WithBasicAuth(cfg.BasicAuthUser, cfg.BasicAuthPassword),
+		server.WithAdminToken(cfg.AdminToken),
+		server.WithMetrics(m),
+		server.WithMetricsToken(cfg.MetricsToken),
+		server.WithLastSeenFlushInterval(cfg.LastSeenFlushInterval),
+		server.WithScheduler(scheduler),
+		server.WithPushAllowedHosts(cfg.AllowedPushHosts()),
+	)
+	if err != nil {
+		fatal("Failed to create server", "error", err)
+	}
+	defer router.Close()
+
+	// Background work runs until the server shuts down
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		scheduler.Run(schedulerCtx)
+	}()
+
+	// Every instance hears about every change, so only the leader pushes
+	pusher := push.NewPusher(repo)
+	pusherDone := make(chan struct{})
+	go func() {
+		defer close(pusherDone)
+		pusher.Run(schedulerCtx)
+	}()
+
+	// Changes made by any instance are streamed to devices connected to this one
+	go repo.ListenForChanges(schedulerCtx, func(event events.Event) {
+		// Before publishing, so that subscribers see the change
+		cachedRepo.Invalidate(event)
+		broker.Publish(event)
+		// Devices only need waking up for data to sync
+		isData := event.Kind == events.ReadMarksChanged || event.Kind == events.FeedsChanged
+		if isData && scheduler.IsLeader() {
+			pusher.Notify(event)
+		}
+	})
+
+	srv := &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           router,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	// Ends open event streams, which would otherwise block shutdown
+	srv.RegisterOnShutdown(broker.Close)
+
+	// Initializing the server in a goroutine so that
+	// it won't block the graceful shutdown handling below
+	go func() {
+		slog.Info("Serving", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("Failed to serve", "error", err)
+		}
+	}()
+
+	// Wait for interrupt signal to gracefully shutdown the server
+	quit := make(chan os.Signal, 1)
+	// kill (no param) default send syscall.SIGTERM
+	// kill -2 is syscall.SIGINT
+	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	slog.Info("Shutting down server")
+	stopScheduler()
+	<-schedulerDone
+	<-pusherDone
+
+	// The context is used to inform the server how long it has to finish
+	// the requests it is currently handling
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fatal("Server forced to shutdown", "error", err)
+	}
+
+	slog.Info("Server exiting")
+}
+
+// Replicas starting at the same time wait for each other instead of racing
+func migrateWithLock(repo *repository.PostgresRepository, conn string) error {
+	ctx := context.Background()
+	lock := repo.NewAdvisoryLock(migrations.LockKey)
+
+	slog.Info("Waiting for the migration lock")
+	if err := lock.Acquire(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(ctx); err != nil {
+			slog.Error("Failed to release the migration lock", "error", err)
+		}
+	}()
+
+	return migrations.RunMigrations(conn)
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetReturnsWhatWasSet(t *testing.T) {
+	c := New[string, int](10, time.Minute)
+	c.Set("a", 1)
+
+	if value, ok := c.Get("a"); !ok || value != 1 {
+		t.Errorf("Get(a) = %d, %t; want 1, true", value, ok)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("Get(b) found a value which was never set")
+	}
+}
+
+func TestEntriesExpire(t *testing.T) {
+	now := time.Now()
+	c := New[string, int](10, time.Minute)
+	c.now = func() time.Time { return now }
+	c.Set("a", 1)
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("Get(a) found an expired value")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d; want expired entry removed", c.Len())
+	}
+}
+
+func TestLeastRecentlyUsedIsEvicted(t *testing.T) {
+	c := New[string, int](2, time.Minute)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Set("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("a should have been kept")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Error("c should have been kept")
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	c := New[string, int](10, time.Minute)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 1)
+
+	c.DeleteFunc(func(key string, value int) bool { return value == 1 })
+
+	if c.Len() != 1 {
+		t.Errorf("Len() = %d; want 1", c.Len())
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Error("b should have been kept")
+	}
+}
+
+func TestDisabledCacheStoresNothing(t *testing.T) {
+	c := New[string, int](10, 0)
+	c.Set("a", 1)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("a disabled cache returned a value")
+	}
+}
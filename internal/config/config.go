@@ -0,0 +1,430 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spacecowboy/feeder-sync/internal/lastseen"
+	"github.com/spacecowboy/feeder-sync/internal/logging"
+	"github.com/spacecowboy/feeder-sync/internal/middleware"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+	"github.com/spacecowboy/feeder-sync/internal/server"
+	"github.com/spacecowboy/feeder-sync/internal/tracing"
+	"gopkg.in/yaml.v2"
+)
+
+// Every setting can also be given as an environment variable, named after the flag.
+// For example, -postgres-conn is read from FEEDER_SYNC_POSTGRES_CONN.
+const envPrefix = "FEEDER_SYNC_"
+
+// Flag, and environment variable, naming the optional config file.
+// The file is YAML mapping setting names, as the flags are named, to values.
+const fileSetting = "config"
+
+// Settings which are never printed
+var secrets = []string{"postgres-conn", "basic-auth-password", "admin-token", "metrics-token"}
+
+// Config of all commands. Zero durations disable the related job.
+type Config struct {
+	ListenAddr string
+
+	PostgresConn string
+	// Pending migrations are applied by serve before serving
+	MigrateOnStart bool
+	// Zero uses the driver's default
+	DbMaxConns int
+	DbMinConns int
+
+	// Credentials every client sends. The defaults are those built into the app.
+	BasicAuthUser     string
+	BasicAuthPassword string
+	// Admin endpoints are disabled when empty
+	AdminToken string
+	// Bearer token of /metrics, which is disabled when empty
+	MetricsToken string
+
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+
+	MaxReadMarks           int64
+	MaxReadMarksPerRequest int
+	MaxIdentifierLength    int
+	MaxFeedsBytes          int64
+	MaxFeedsVersions       int
+	MaxDevices             int64
+
+	DeviceStaleAfter      time.Duration
+	LastSeenFlushInterval time.Duration
+	CacheSize             int
+	CacheTTL              time.Duration
+
+	ReadMarkRetention     time.Duration
+	ReadMarkPruneInterval time.Duration
+	DeviceRetention       time.Duration
+	DeviceReapInterval    time.Duration
+
+	LogLevel  string
+	LogFormat string
+
+	// Comma separated. Any public host if empty.
+	PushAllowedHosts string
+
+	// Spans are only exported when set
+	OtlpEndpoint     string
+	TraceSampleRatio float64
+}
+
+func Default() Config {
+	limits := server.DefaultLimits()
+	return Config{
+		ListenAddr:             ":34217",
+		BasicAuthUser:          middleware.HARDCODED_USER,
+		BasicAuthPassword:      middleware.HARDCODED_PASSWORD,
+		ReadHeaderTimeout:      10 * time.Second,
+		IdleTimeout:            2 * time.Minute,
+		ShutdownTimeout:        5 * time.Second,
+		MaxReadMarks:           limits.MaxReadMarks,
+		MaxReadMarksPerRequest: limits.MaxReadMarksPerRequest,
+		MaxIdentifierLength:    limits.MaxIdentifierLength,
+		MaxFeedsBytes:          limits.MaxFeedsBytes,
+		MaxFeedsVersions:       limits.MaxFeedsVersions,
+		MaxDevices:             limits.MaxDevices,
+		DeviceStaleAfter:       server.DefaultDeviceStaleAfter,
+		LastSeenFlushInterval:  lastseen.DefaultFlushInterval,
+		CacheSize:              repository.DefaultCacheSize,
+		CacheTTL:               repository.DefaultCacheTTL,
+		ReadMarkPruneInterval:  time.Hour,
+		DeviceReapInterval:     time.Hour,
+		LogLevel:               "info",
+		LogFormat:              "text",
+		TraceSampleRatio:       1,
+	}
+}
+
+// Limits returns the configured limits of the server
+func (c Config) Limits() server.Limits {
+	return server.Limits{
+		MaxReadMarks:           c.MaxReadMarks,
+		MaxReadMarksPerRequest: c.MaxReadMarksPerRequest,
+		MaxIdentifierLength:    c.MaxIdentifierLength,
+		MaxFeedsBytes:          c.MaxFeedsBytes,
+		MaxFeedsVersions:       c.MaxFeedsVersions,
+		MaxDevices:             c.MaxDevices,
+	}
+}
+
+// Binds every setting to its field. The current values are the defaults.
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", name)
+		fmt.Fprintf(fs.Output(), "Every flag can also be set with the environment variable %s<FLAG>, like %s.\n", envPrefix, envName("postgres-conn"))
+		fs.PrintDefaults()
+	}
+
+	fs.String(fileSetting, "", "Path of an optional YAML config file")
+
+	fs.StringVar(&c.ListenAddr, "listen-addr", c.ListenAddr, "Address to serve on")
+
+	fs.StringVar(&c.PostgresConn, "postgres-conn", c.PostgresConn, "Postgres connection string (required)")
+	fs.BoolVar(&c.MigrateOnStart, "migrate-on-start", c.MigrateOnStart, "Apply pending migrations before serving")
+	fs.IntVar(&c.DbMaxConns, "db-max-conns", c.DbMaxConns, "Maximum size of the database pool, 0 for the driver default")
+	fs.IntVar(&c.DbMinConns, "db-min-conns", c.DbMinConns, "Minimum size of the database pool")
+
+	fs.StringVar(&c.BasicAuthUser, "basic-auth-user", c.BasicAuthUser, "Basic auth user of the API")
+	fs.StringVar(&c.BasicAuthPassword, "basic-auth-password", c.BasicAuthPassword, "Basic auth password of the API")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Bearer token of the admin endpoints, empty to disable them")
+	fs.StringVar(&c.MetricsToken, "metrics-token", c.MetricsToken, "Bearer token of the metrics endpoint, empty to disable it")
+
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "Time allowed to read request headers")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "Time an idle keep-alive connection is kept open")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "Time given to requests in flight on shutdown")
+
+	fs.Int64Var(&c.MaxReadMarks, "max-readmarks", c.MaxReadMarks, "Read marks stored per chain, 0 for unlimited")
+	fs.IntVar(&c.MaxReadMarksPerRequest, "max-readmarks-per-request", c.MaxReadMarksPerRequest, "Read marks accepted per request, 0 for unlimited")
+	fs.IntVar(&c.MaxIdentifierLength, "max-identifier-length", c.MaxIdentifierLength, "Length of a read mark identifier, 0 for unlimited")
+	fs.Int64Var(&c.MaxFeedsBytes, "max-feeds-bytes", c.MaxFeedsBytes, "Size of the feeds stored per chain, 0 for unlimited")
+	fs.IntVar(&c.MaxFeedsVersions, "max-feeds-versions", c.MaxFeedsVersions, "Earlier feeds kept per chain after merges, 0 for unlimited")
+	fs.Int64Var(&c.MaxDevices, "max-devices", c.MaxDevices, "Devices per chain, 0 for unlimited")
+
+	fs.DurationVar(&c.DeviceStaleAfter, "device-stale-after", c.DeviceStaleAfter, "Devices not seen for this long are marked as stale, 0 to disable")
+	fs.DurationVar(&c.LastSeenFlushInterval, "last-seen-flush-interval", c.LastSeenFlushInterval, "How often last seen times are written")
+	fs.IntVar(&c.CacheSize, "cache-size", c.CacheSize, "Users and devices kept in the authentication cache")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", c.CacheTTL, "Time entries are kept in the authentication cache, 0 to disable")
+
+	fs.DurationVar(&c.ReadMarkRetention, "readmark-retention", c.ReadMarkRetention, "Read marks older than this are pruned, 0 to keep them")
+	fs.DurationVar(&c.ReadMarkPruneInterval, "readmark-prune-interval", c.ReadMarkPruneInterval, "How often read marks are pruned")
+	fs.DurationVar(&c.DeviceRetention, "device-retention", c.DeviceRetention, "Devices not seen for this long are deleted, 0 to keep them")
+	fs.DurationVar(&c.DeviceReapInterval, "device-reap-interval", c.DeviceReapInterval, "How often devices are reaped")
+
+	fs.StringVar(&c.PushAllowedHosts, "push-allowed-hosts", c.PushAllowedHosts, "Comma separated hosts, and their subdomains, which push endpoints may point to, empty for any public host")
+
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "One of debug, info, warn, error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "One of text, json")
+
+	fs.StringVar(&c.OtlpEndpoint, "otlp-endpoint", c.OtlpEndpoint, "Base URL of an OTLP/HTTP collector to export traces to, empty to disable. Headers are read from OTEL_EXPORTER_OTLP_HEADERS.")
+	fs.Float64Var(&c.TraceSampleRatio, "trace-sample-ratio", c.TraceSampleRatio, "Fraction of traces exported, unless the client decided")
+
+	return fs
+}
+
+// Load reads the config from, in increasing priority, defaults, the config file,
+// the environment and the command line arguments. The result is validated.
+func Load(name string, args []string, getenv func(string) string) (Config, error) {
+	c := Default()
+	fs := c.flagSet(name)
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if fs.NArg() > 0 {
+		return c, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	// Flags win, so are applied again last
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	path := explicit[fileSetting]
+	if path == "" {
+		path = getenv(envName(fileSetting))
+	}
+	if path != "" {
+		if err := loadFile(fs, path); err != nil {
+			return c, err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if raw := getenv(envName(f.Name)); raw != "" && f.Name != fileSetting {
+			if err := f.Value.Set(raw); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", envName(f.Name), err))
+			}
+		}
+	})
+	for name, raw := range explicit {
+		_ = fs.Set(name, raw)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return c, err
+	}
+
+	return c, c.Validate()
+}
+
+func envName(setting string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+func loadFile(fs *flag.FlagSet, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]any
+	if err := yaml.UnmarshalStrict(content, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var errs []error
+	for name, value := range values {
+		if name == fileSetting || fs.Lookup(name) == nil {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, name))
+			continue
+		}
+		if err := fs.Set(name, fmt.Sprint(value)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate returns all invalid values at once
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(setting string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", setting, fmt.Sprintf(format, args...)))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		invalid("listen-addr", "%v", err)
+	}
+
+	if c.PostgresConn == "" {
+		invalid("postgres-conn", "must be set")
+	} else if _, err := pgxpool.ParseConfig(c.PostgresConn); err != nil {
+		// The error may contain the password
+		invalid("postgres-conn", "not a valid connection string")
+	}
+	if c.DbMaxConns < 0 {
+		invalid("db-max-conns", "must not be negative")
+	}
+	if c.DbMinConns < 0 {
+		invalid("db-min-conns", "must not be negative")
+	}
+	if c.DbMaxConns > 0 && c.DbMinConns > c.DbMaxConns {
+		invalid("db-min-conns", "must not be more than db-max-conns")
+	}
+
+	if c.BasicAuthUser == "" {
+		invalid("basic-auth-user", "must be set")
+	}
+	if c.BasicAuthPassword == "" {
+		invalid("basic-auth-password", "must be set")
+	}
+
+	positive := map[string]time.Duration{
+		"read-header-timeout":      c.ReadHeaderTimeout,
+		"idle-timeout":             c.IdleTimeout,
+		"shutdown-timeout":         c.ShutdownTimeout,
+		"last-seen-flush-interval": c.LastSeenFlushInterval,
+		"readmark-prune-interval":  c.ReadMarkPruneInterval,
+		"device-reap-interval":     c.DeviceReapInterval,
+	}
+	for setting, value := range positive {
+		if value <= 0 {
+			invalid(setting, "must be positive")
+		}
+	}
+	nonNegative := map[string]time.Duration{
+		"device-stale-after": c.DeviceStaleAfter,
+		"cache-ttl":          c.CacheTTL,
+		"readmark-retention": c.ReadMarkRetention,
+		"device-retention":   c.DeviceRetention,
+	}
+	for setting, value := range nonNegative {
+		if value < 0 {
+			invalid(setting, "must not be negative")
+		}
+	}
+
+	limits := map[string]int64{
+		"max-readmarks":             c.MaxReadMarks,
+		"max-readmarks-per-request": int64(c.MaxReadMarksPerRequest),
+		"max-identifier-length":     int64(c.MaxIdentifierLength),
+		"max-feeds-bytes":           c.MaxFeedsBytes,
+		"max-feeds-versions":        int64(c.MaxFeedsVersions),
+		"max-devices":               c.MaxDevices,
+	}
+	for setting, value := range limits {
+		if value < 0 {
+			invalid(setting, "must not be negative")
+		}
+	}
+	if c.CacheSize < 0 {
+		invalid("cache-size", "must not be negative")
+	}
+
+	if !slices.Contains([]string{"debug", "info", "warn", "error"}, c.LogLevel) {
+		invalid("log-level", "must be one of debug, info, warn, error")
+	}
+	if !slices.Contains([]string{"text", "json"}, c.LogFormat) {
+		invalid("log-format", "must be one of text, json")
+	}
+
+	if c.OtlpEndpoint != "" {
+		if u, err := url.Parse(c.OtlpEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("otlp-endpoint", "must be an http or https URL")
+		}
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		invalid("trace-sample-ratio", "must be between 0 and 1")
+	}
+
+	// Map iteration order is random
+	slices.SortFunc(errs, func(a, b error) int {
+		return strings.Compare(a.Error(), b.Error())
+	})
+	return errors.Join(errs...)
+}
+
+// PoolConfig returns the database pool config with the configured sizes
+func (c Config) PoolConfig() (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(c.PostgresConn)
+	if err != nil {
+		return nil, errors.New("postgres-conn: not a valid connection string")
+	}
+	if c.DbMaxConns > 0 {
+		poolConfig.MaxConns = int32(c.DbMaxConns)
+	}
+	poolConfig.MinConns = int32(c.DbMinConns)
+	return poolConfig, nil
+}
+
+// AllowedPushHosts returns the hosts push endpoints may point to, or nil for any public host
+func (c Config) AllowedPushHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(c.PushAllowedHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Tracing returns the options of the trace exporter
+func (c Config) Tracing() tracing.Options {
+	return tracing.Options{
+		Endpoint:    c.OtlpEndpoint,
+		SampleRatio: c.TraceSampleRatio,
+	}
+}
+
+// Logger returns a logger writing to w at the configured level and format.
+// Records logged with the context of a request carry its request and trace ids. Secrets are redacted.
+func (c Config) Logger(w io.Writer) *slog.Logger {
+	var level slog.Level
+	// Validated already
+	_ = level.UnmarshalText([]byte(c.LogLevel))
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: logging.Redact}
+	var handler slog.Handler = slog.NewTextHandler(w, options)
+	if c.LogFormat == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	return slog.New(logging.ContextHandler(tracing.LogHandler(handler)))
+}
+
+// Print writes every setting, one per line, with secrets redacted
+func (c Config) Print(w io.Writer) {
+	c.visitSettings(func(name string, value string) {
+		fmt.Fprintf(w, "%s = %q\n", name, value)
+	})
+}
+
+// LogValue logs every setting, with secrets redacted
+func (c Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	c.visitSettings(func(name string, value string) {
+		attrs = append(attrs, slog.String(name, value))
+	})
+	return slog.GroupValue(attrs...)
+}
+
+// Visits settings in the order of their names
+func (c Config) visitSettings(fn func(name string, value string)) {
+	c.flagSet("").VisitAll(func(f *flag.Flag) {
+		if f.Name == fileSetting {
+			return
+		}
+		value := f.Value.String()
+		if value != "" && slices.Contains(secrets, f.Name) {
+			value = logging.Redacted
+		}
+		fn(f.Name, value)
+	})
+}
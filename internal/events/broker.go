@@ -0,0 +1,135 @@
+package events
+
+import (
+	"sync"
+)
+
+// Kind is what changed for a user
+type Kind string
+
+const (
+	ReadMarksChanged Kind = "readmarks"
+	FeedsChanged     Kind = "feeds"
+	DevicesChanged   Kind = "devices"
+	// The chain was merged into another chain, and no longer exists
+	ChainMerged Kind = "merged"
+)
+
+// Event is a notification that something changed for a user.
+// It carries no data. Clients are expected to fetch the changes themselves.
+type Event struct {
+	UserDbID int64
+	Kind     Kind
+	// The device which made the change. Zero if unknown.
+	SourceDeviceDbID int64
+	// Increases with every change across all instances. Zero if unknown.
+	Sequence int64
+}
+
+// Number of events a subscriber can lag behind before events are dropped.
+// Events only say that something changed, so a dropped event is covered by
+// any other pending event of the same kind.
+const subscriptionBuffer = 16
+
+// Broker dispatches events to subscribers in this process
+type Broker struct {
+	mutex       sync.Mutex
+	closed      bool
+	subscribers map[int64]map[*Subscription]struct{}
+}
+
+// Subscription receives the events of a single user, except those made by its own device
+type Subscription struct {
+	broker     *Broker
+	userDbID   int64
+	deviceDbID int64
+	events     chan Event
+	closeOnce  sync.Once
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subscribers: make(map[int64]map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe to events of the given user. Events made by the given device are not delivered.
+// The subscription must be closed when no longer needed.
+func (b *Broker) Subscribe(userDbID int64, deviceDbID int64) *Subscription {
+	sub := &Subscription{
+		broker:     b,
+		userDbID:   userDbID,
+		deviceDbID: deviceDbID,
+		events:     make(chan Event, subscriptionBuffer),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		close(sub.events)
+		return sub
+	}
+
+	subs, ok := b.subscribers[userDbID]
+	if !ok {
+		subs = make(map[*Subscription]struct{})
+		b.subscribers[userDbID] = subs
+	}
+	subs[sub] = struct{}{}
+
+	return sub
+}
+
+// Publish delivers the event to all subscribers of the user. Never blocks.
+func (b *Broker) Publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.subscribers[event.UserDbID] {
+		if event.SourceDeviceDbID != 0 && event.SourceDeviceDbID == sub.deviceDbID {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			// Subscriber is lagging behind. See subscriptionBuffer.
+		}
+	}
+}
+
+// Close ends all subscriptions. Events published afterwards are dropped.
+func (b *Broker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for _, subs := range b.subscribers {
+		for sub := range subs {
+			sub.closeOnce.Do(func() { close(sub.events) })
+		}
+	}
+	b.subscribers = make(map[int64]map[*Subscription]struct{})
+}
+
+func (b *Broker) remove(sub *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subs := b.subscribers[sub.userDbID]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subscribers, sub.userDbID)
+	}
+	sub.closeOnce.Do(func() { close(sub.events) })
+}
+
+// Events is closed when the subscription or the broker is closed
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Subscription) Close() {
+	s.broker.remove(s)
+}
@@ -0,0 +1,70 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestPublishSkipsOwnDeviceAndOtherUsers(t *testing.T) {
+	broker := NewBroker()
+
+	own := broker.Subscribe(1, 10)
+	defer own.Close()
+	other := broker.Subscribe(1, 11)
+	defer other.Close()
+	otherUser := broker.Subscribe(2, 20)
+	defer otherUser.Close()
+
+	broker.Publish(Event{UserDbID: 1, Kind: ReadMarksChanged, SourceDeviceDbID: 10})
+
+	select {
+	case event := <-other.Events():
+		if event.Kind != ReadMarksChanged {
+			t.Errorf("Kind = %q; want %q", event.Kind, ReadMarksChanged)
+		}
+	default:
+		t.Fatal("other device did not get the event")
+	}
+
+	select {
+	case event := <-own.Events():
+		t.Errorf("own device got its own event: %+v", event)
+	default:
+	}
+
+	select {
+	case event := <-otherUser.Events():
+		t.Errorf("other user got the event: %+v", event)
+	default:
+	}
+}
+
+func TestCloseEndsSubscriptions(t *testing.T) {
+	broker := NewBroker()
+	sub := broker.Subscribe(1, 10)
+
+	broker.Close()
+	// Closing the subscription after the broker must be safe
+	sub.Close()
+
+	if _, ok := <-sub.Events(); ok {
+		t.Error("expected events to be closed")
+	}
+
+	if _, ok := <-broker.Subscribe(1, 10).Events(); ok {
+		t.Error("expected subscriptions on a closed broker to be closed")
+	}
+}
+
+func TestPublishDoesNotBlockOnSlowSubscriber(t *testing.T) {
+	broker := NewBroker()
+	sub := broker.Subscribe(1, 10)
+	defer sub.Close()
+
+	for range subscriptionBuffer * 2 {
+		broker.Publish(Event{UserDbID: 1, Kind: FeedsChanged})
+	}
+
+	if got := len(sub.Events()); got != subscriptionBuffer {
+		t.Errorf("buffered %d events; want %d", got, subscriptionBuffer)
+	}
+}
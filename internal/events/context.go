@@ -0,0 +1,16 @@
+package events
+
+import "context"
+
+type sourceDeviceKey struct{}
+
+// WithSourceDevice marks changes made with the returned context as made by the given device
+func WithSourceDevice(ctx context.Context, deviceDbID int64) context.Context {
+	return context.WithValue(ctx, sourceDeviceKey{}, deviceDbID)
+}
+
+// SourceDevice returns the device making changes with this context, or zero if unknown
+func SourceDevice(ctx context.Context) int64 {
+	deviceDbID, _ := ctx.Value(sourceDeviceKey{}).(int64)
+	return deviceDbID
+}
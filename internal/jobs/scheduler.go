@@ -0,0 +1,222 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Key of the Postgres advisory lock which the leader holds.
+// Only the leader runs jobs, so running several replicas doesn't duplicate work.
+const LeaderLockKey int64 = 0x66656564_65720001
+
+const DefaultTickInterval = 15 * time.Second
+
+// RunFunc performs a single run of a job. The result is reported as is in the job status,
+// so it should marshal to JSON.
+type RunFunc func(ctx context.Context) (any, error)
+
+// Locker elects a single leader among all running instances
+type Locker interface {
+	// Returns true if this instance is the leader after the call
+	TryAcquire(ctx context.Context) (bool, error)
+	Release(ctx context.Context) error
+}
+
+// Scheduler runs named periodic jobs, but only while this instance is the leader
+type Scheduler struct {
+	locker       Locker
+	tickInterval time.Duration
+
+	mutex  sync.Mutex
+	leader bool
+	jobs   []*job
+}
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      RunFunc
+
+	running       bool
+	runs          int64
+	nextRunAt     time.Time
+	lastStartedAt time.Time
+	lastDuration  time.Duration
+	lastResult    any
+	lastError     error
+}
+
+type Status struct {
+	Leader bool        `json:"leader"`
+	Jobs   []JobStatus `json:"jobs"`
+}
+
+type JobStatus struct {
+	Name               string     `json:"name"`
+	Interval           string     `json:"interval"`
+	Running            bool       `json:"running"`
+	Runs               int64      `json:"runs"`
+	NextRunAt          *time.Time `json:"nextRunAt,omitempty"`
+	LastStartedAt      *time.Time `json:"lastStartedAt,omitempty"`
+	LastDurationMillis int64      `json:"lastDurationMillis"`
+	LastResult         any        `json:"lastResult,omitempty"`
+	LastError          string     `json:"lastError,omitempty"`
+}
+
+func NewScheduler(locker Locker) *Scheduler {
+	return &Scheduler{
+		locker:       locker,
+		tickInterval: DefaultTickInterval,
+	}
+}
+
+// Register adds a job which runs every interval. Must be called before Run.
+func (s *Scheduler) Register(name string, interval time.Duration, run RunFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		interval: interval,
+		run:      run,
+	})
+}
+
+// Run blocks until the context is cancelled. Leadership is released on return.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.tickInterval)
+	defer ticker.Stop()
+
+	defer func() {
+		// The run context is already done at this point
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.locker.Release(releaseCtx); err != nil {
+			slog.Error("Failed to release scheduler leadership", "error", err)
+		}
+		s.setLeader(false)
+	}()
+
+	for {
+		s.tick(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) tick(ctx context.Context) {
+	leader, err := s.locker.TryAcquire(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to check scheduler leadership", "error", err)
+	}
+	s.setLeader(leader)
+
+	if !leader {
+		return
+	}
+
+	for _, j := range s.dueJobs(time.Now()) {
+		if ctx.Err() != nil {
+			return
+		}
+		s.runJob(ctx, j)
+	}
+}
+
+func (s *Scheduler) setLeader(leader bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if leader != s.leader {
+		slog.Info("Scheduler leadership changed", "leader", leader)
+	}
+	s.leader = leader
+}
+
+func (s *Scheduler) dueJobs(now time.Time) []*job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var due []*job
+	for _, j := range s.jobs {
+		if !now.Before(j.nextRunAt) {
+			due = append(due, j)
+		}
+	}
+	return due
+}
+
+func (s *Scheduler) runJob(ctx context.Context, j *job) {
+	startedAt := time.Now()
+
+	s.mutex.Lock()
+	j.running = true
+	j.lastStartedAt = startedAt
+	s.mutex.Unlock()
+
+	result, err := j.run(ctx)
+	duration := time.Since(startedAt)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Job failed", "job", j.name, "duration", duration, "error", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	j.running = false
+	j.runs++
+	j.nextRunAt = startedAt.Add(j.interval)
+	j.lastDuration = duration
+	j.lastResult = result
+	j.lastError = err
+}
+
+// IsLeader returns true if this instance was the leader at the last check
+func (s *Scheduler) IsLeader() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.leader
+}
+
+// Status reports leadership and the last run of every registered job
+func (s *Scheduler) Status() Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := Status{
+		Leader: s.leader,
+		Jobs:   make([]JobStatus, 0, len(s.jobs)),
+	}
+
+	for _, j := range s.jobs {
+		jobStatus := JobStatus{
+			Name:               j.name,
+			Interval:           j.interval.String(),
+			Running:            j.running,
+			Runs:               j.runs,
+			LastDurationMillis: j.lastDuration.Milliseconds(),
+			LastResult:         j.lastResult,
+		}
+		if !j.nextRunAt.IsZero() {
+			nextRunAt := j.nextRunAt
+			jobStatus.NextRunAt = &nextRunAt
+		}
+		if !j.lastStartedAt.IsZero() {
+			lastStartedAt := j.lastStartedAt
+			jobStatus.LastStartedAt = &lastStartedAt
+		}
+		if j.lastError != nil {
+			jobStatus.LastError = j.lastError.Error()
+		}
+		status.Jobs = append(status.Jobs, jobStatus)
+	}
+
+	return status
+}
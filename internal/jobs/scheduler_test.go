@@ -0,0 +1,65 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeLocker struct {
+	leader bool
+}
+
+func (l *fakeLocker) TryAcquire(ctx context.Context) (bool, error) {
+	return l.leader, nil
+}
+
+func (l *fakeLocker) Release(ctx context.Context) error {
+	return nil
+}
+
+func TestOnlyLeaderRunsJobs(t *testing.T) {
+	locker := &fakeLocker{leader: false}
+	scheduler := NewScheduler(locker)
+
+	runs := 0
+	scheduler.Register("count", time.Hour, func(ctx context.Context) (any, error) {
+		runs++
+		return runs, nil
+	})
+
+	scheduler.tick(context.Background())
+	if runs != 0 {
+		t.Fatalf("runs = %d while not leader; want 0", runs)
+	}
+
+	locker.leader = true
+	scheduler.tick(context.Background())
+	// Not due again until the interval has passed
+	scheduler.tick(context.Background())
+	if runs != 1 {
+		t.Fatalf("runs = %d as leader; want 1", runs)
+	}
+
+	status := scheduler.Status()
+	if !status.Leader {
+		t.Error("expected to be leader")
+	}
+	if got := status.Jobs[0]; got.Runs != 1 || got.LastResult != 1 || got.NextRunAt == nil {
+		t.Errorf("unexpected status: %+v", got)
+	}
+}
+
+func TestStatusReportsLastError(t *testing.T) {
+	scheduler := NewScheduler(&fakeLocker{leader: true})
+	scheduler.Register("fail", time.Minute, func(ctx context.Context) (any, error) {
+		return nil, errors.New("boom")
+	})
+
+	scheduler.tick(context.Background())
+
+	if got := scheduler.Status().Jobs[0].LastError; got != "boom" {
+		t.Errorf("LastError = %q; want %q", got, "boom")
+	}
+}
@@ -0,0 +1,102 @@
+package lastseen
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/build/gen/db"
+)
+
+const (
+	DefaultFlushInterval = 30 * time.Second
+	// Devices seen more recently than this are not updated again
+	Accuracy = time.Minute
+	// Time given to the final flush on shutdown
+	shutdownFlushTimeout = 5 * time.Second
+)
+
+// Store persists when devices were last seen
+type Store interface {
+	UpdateLastSeen(ctx context.Context, lastSeen map[int64]time.Time) error
+}
+
+// Tracker records when devices were last seen in memory,
+// and writes them to the store periodically in a single batch
+type Tracker struct {
+	store         Store
+	flushInterval time.Duration
+	now           func() time.Time
+
+	mutex   sync.Mutex
+	pending map[int64]time.Time
+}
+
+func NewTracker(store Store, flushInterval time.Duration) *Tracker {
+	return &Tracker{
+		store:         store,
+		flushInterval: flushInterval,
+		now:           time.Now,
+		pending:       make(map[int64]time.Time),
+	}
+}
+
+// Seen records that the device made a request. Never touches the store.
+func (t *Tracker) Seen(device db.Device) {
+	now := t.now()
+	if device.LastSeen.Valid && now.Sub(device.LastSeen.Time) < Accuracy {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pending[device.DbID] = now
+}
+
+// Run flushes periodically until the context is cancelled, and then once more
+func (t *Tracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+			defer cancel()
+			if err := t.Flush(flushCtx); err != nil {
+				slog.Error("Failed to flush last seen on shutdown", "error", err)
+			}
+			return
+		case <-ticker.C:
+			if err := t.Flush(ctx); err != nil {
+				slog.ErrorContext(ctx, "Failed to flush last seen", "error", err)
+			}
+		}
+	}
+}
+
+// Flush writes everything recorded since the last flush.
+// On failure, the records are kept for the next flush.
+func (t *Tracker) Flush(ctx context.Context) error {
+	t.mutex.Lock()
+	batch := t.pending
+	t.pending = make(map[int64]time.Time)
+	t.mutex.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := t.store.UpdateLastSeen(ctx, batch)
+	if err != nil {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		for deviceDbID, seen := range batch {
+			if newer, ok := t.pending[deviceDbID]; !ok || newer.Before(seen) {
+				t.pending[deviceDbID] = seen
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package lastseen
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/spacecowboy/feeder-sync/build/gen/db"
+)
+
+type fakeStore struct {
+	err     error
+	batches []map[int64]time.Time
+}
+
+func (s *fakeStore) UpdateLastSeen(ctx context.Context, lastSeen map[int64]time.Time) error {
+	s.batches = append(s.batches, lastSeen)
+	return s.err
+}
+
+func newTestTracker(store Store, now time.Time) *Tracker {
+	tracker := NewTracker(store, time.Hour)
+	tracker.now = func() time.Time { return now }
+	return tracker
+}
+
+func device(dbID int64, lastSeen time.Time) db.Device {
+	return db.Device{
+		DbID:     dbID,
+		LastSeen: pgtype.Timestamptz{Time: lastSeen, Valid: true},
+	}
+}
+
+func TestFlushWritesOneBatch(t *testing.T) {
+	now := time.Now()
+	store := &fakeStore{}
+	tracker := newTestTracker(store, now)
+
+	tracker.Seen(device(1, now.Add(-time.Hour)))
+	tracker.Seen(device(2, now.Add(-time.Hour)))
+	tracker.Seen(device(1, now.Add(-time.Hour)))
+
+	if err := tracker.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.batches) != 1 || len(store.batches[0]) != 2 {
+		t.Fatalf("batches = %v; want a single batch of 2", store.batches)
+	}
+
+	// Nothing new to write
+	if err := tracker.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.batches) != 1 {
+		t.Errorf("got %d batches; want 1", len(store.batches))
+	}
+}
+
+func TestSeenSkipsRecentlySeenDevices(t *testing.T) {
+	now := time.Now()
+	store := &fakeStore{}
+	tracker := newTestTracker(store, now)
+
+	tracker.Seen(device(1, now.Add(-Accuracy/2)))
+
+	if err := tracker.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.batches) != 0 {
+		t.Errorf("batches = %v; want none", store.batches)
+	}
+}
+
+func TestFailedFlushIsRetried(t *testing.T) {
+	now := time.Now()
+	store := &fakeStore{err: errors.New("database is down")}
+	tracker := newTestTracker(store, now)
+
+	tracker.Seen(device(1, now.Add(-time.Hour)))
+	if err := tracker.Flush(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	store.err = nil
+	if err := tracker.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.batches) != 2 || !store.batches[1][1].Equal(now) {
+		t.Errorf("batches = %v; want device 1 written again", store.batches)
+	}
+}
+
+func TestRunFlushesOnShutdown(t *testing.T) {
+	now := time.Now()
+	store := &fakeStore{}
+	tracker := newTestTracker(store, now)
+	tracker.Seen(device(1, now.Add(-time.Hour)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.Run(ctx)
+
+	if len(store.batches) != 1 {
+		t.Errorf("got %d batches; want 1", len(store.batches))
+	}
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// Logged in place of secrets
+const Redacted = "[REDACTED]"
+
+// Keys of attributes which are never logged. Sync codes and user ids grant access to a chain,
+// so are as secret as tokens.
+var secretKeys = map[string]bool{
+	"sync_code":     true,
+	"user_id":       true,
+	"token":         true,
+	"password":      true,
+	"authorization": true,
+}
+
+// IsSecret reports whether values of the attribute key must be redacted
+func IsSecret(key string) bool {
+	key = strings.ToLower(key)
+	return secretKeys[key] || strings.HasSuffix(key, "_token") || strings.HasSuffix(key, "_password")
+}
+
+// Redact replaces the values of secret attributes, and URLs in errors. Meant as the ReplaceAttr of handler options.
+func Redact(_ []string, a slog.Attr) slog.Attr {
+	if IsSecret(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	if err, ok := a.Value.Any().(error); ok && a.Value.Kind() == slog.KindAny {
+		return slog.String(a.Key, redactUrls(err))
+	}
+	return a
+}
+
+// Errors of the HTTP client carry the URL requested, which may be a capability URL like a push endpoint
+func redactUrls(err error) string {
+	message := err.Error()
+	for urlErr := (*url.Error)(nil); errors.As(err, &urlErr); err = urlErr.Err {
+		if urlErr.URL != "" {
+			message = strings.ReplaceAll(message, urlErr.URL, Redacted)
+		}
+	}
+	return message
+}
+
+type requestIdKey struct{}
+
+// WithRequestId returns a context whose log records carry the request id
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// RequestId returns the id of the request the context belongs to, or an empty string
+func RequestId(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+// ContextHandler adds the request id in the context, if any, to every record logged with a context
+func ContextHandler(h slog.Handler) slog.Handler {
+	return contextHandler{h}
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if requestId := RequestId(ctx); requestId != "" {
+		r.AddAttrs(slog.String("request_id", requestId))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,159 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logs through the default logger, like in production
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var out bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(ContextHandler(slog.NewTextHandler(&out, &slog.HandlerOptions{ReplaceAttr: Redact}))))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+	return &out
+}
+
+func newRouter(handler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.ContextWithFallback = true
+	router.Use(Middleware("/health"), Recovery())
+	router.GET("/api/v1/devices/:id", handler)
+	router.GET("/health", handler)
+	return router
+}
+
+func TestMiddlewareEchoesRequestId(t *testing.T) {
+	captureLogs(t)
+	var seen string
+	router := newRouter(func(c *gin.Context) {
+		seen = RequestId(c)
+	})
+
+	for _, test := range []struct {
+		name     string
+		incoming string
+		kept     bool
+	}{
+		{"none", "", false},
+		{"valid", "proxy-1.a_b", true},
+		{"forged line", "x\nlevel=ERROR", false},
+		{"too long", strings.Repeat("a", maxRequestIdLength+1), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/devices/1", nil)
+			if test.incoming != "" {
+				request.Header.Set(RequestIdHeader, test.incoming)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			echoed := recorder.Header().Get(RequestIdHeader)
+			if echoed == "" || echoed != seen {
+				t.Errorf("echoed %q, handler saw %q", echoed, seen)
+			}
+			if kept := echoed == test.incoming; kept != test.kept {
+				t.Errorf("kept = %t; want %t", kept, test.kept)
+			}
+		})
+	}
+}
+
+func TestMiddlewareLogsRouteWithRequestId(t *testing.T) {
+	out := captureLogs(t)
+	router := newRouter(func(c *gin.Context) {
+		slog.InfoContext(c, "Handling")
+		c.Status(http.StatusNoContent)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/devices/1234", nil)
+	request.Header.Set(RequestIdHeader, "req-1")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines; want two from the handler and one request:\n%s", len(lines), out)
+	}
+	handled, requested := lines[0], lines[1]
+	for _, line := range []string{handled, requested} {
+		if !strings.Contains(line, "request_id=req-1") {
+			t.Errorf("line has no request id: %s", line)
+		}
+	}
+	if !strings.Contains(requested, "msg=Request") || !strings.Contains(requested, "route=/api/v1/devices/:id") || !strings.Contains(requested, "status=204") {
+		t.Errorf("unexpected request line: %s", requested)
+	}
+	if strings.Contains(lines[2], "msg=Request") {
+		t.Errorf("skipped path was logged: %s", lines[2])
+	}
+	if strings.Contains(out.String(), "1234") {
+		t.Errorf("path was logged: %s", out)
+	}
+}
+
+func TestRecoveryLogsPanics(t *testing.T) {
+	out := captureLogs(t)
+	router := newRouter(func(c *gin.Context) {
+		panic("boom")
+	})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/devices/1", nil))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d; want 500", recorder.Code)
+	}
+	if !strings.Contains(out.String(), "level=ERROR msg=\"Request panicked\" error=boom") {
+		t.Errorf("panic was not logged: %s", out)
+	}
+}
+
+func TestUrlsInErrorsAreRedacted(t *testing.T) {
+	out := captureLogs(t)
+
+	endpoint := "https://push.example.com/wpush/v2/gAAAAABsecret"
+	err := fmt.Errorf("push failed: %w", &url.Error{Op: "Post", URL: endpoint, Err: errors.New("connection refused")})
+	slog.ErrorContext(context.Background(), "Push failed", "error", err)
+
+	if strings.Contains(out.String(), "gAAAAABsecret") {
+		t.Errorf("url was logged: %s", out)
+	}
+	if !strings.Contains(out.String(), "connection refused") {
+		t.Errorf("cause was not logged: %s", out)
+	}
+}
+
+func TestSecretsAreRedacted(t *testing.T) {
+	out := captureLogs(t)
+
+	slog.InfoContext(context.Background(), "Secrets",
+		"sync_code", "feed1234",
+		"user_id", "0f3ab4c8-6bb3-4a4b-8d49-0e8f0a7a0b3e",
+		"admin_token", "hunter2",
+		slog.Group("request", "Authorization", "Basic abc"),
+		"user_db_id", 42,
+	)
+
+	for _, secret := range []string{"feed1234", "0f3ab4c8", "hunter2", "Basic abc"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("%q was logged: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out.String(), "user_db_id=42") {
+		t.Errorf("database id was redacted: %s", out)
+	}
+}
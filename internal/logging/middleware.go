@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Carries the request id in both directions
+const RequestIdHeader = "X-Request-ID"
+
+// Longest request id accepted from clients
+const maxRequestIdLength = 128
+
+// Middleware gives every request an id, echoed in the response header, and logs every request once handled.
+// Requests to the skipped paths are not logged.
+func Middleware(skipPaths ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		// Kept when set by a proxy, so that its lines can be matched with ours
+		requestId := c.GetHeader(RequestIdHeader)
+		if !validRequestId(requestId) {
+			requestId = uuid.NewString()
+		}
+		c.Header(RequestIdHeader, requestId)
+		c.Request = c.Request.WithContext(WithRequestId(c.Request.Context(), requestId))
+
+		c.Next()
+
+		if slices.Contains(skipPaths, c.Request.URL.Path) {
+			return
+		}
+		// The route, not the path, as paths contain ids
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", route),
+			slog.Int("status", c.Writer.Status()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if errs := c.Errors.ByType(gin.ErrorTypePrivate); len(errs) > 0 {
+			attrs = append(attrs, slog.String("error", errs.String()))
+		}
+		slog.LogAttrs(c.Request.Context(), slog.LevelInfo, "Request", attrs...)
+	}
+}
+
+// Ids are logged, so must not be able to forge log lines
+func validRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for _, r := range requestId {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Recovery logs panics with the request's context, and responds with 500
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		slog.ErrorContext(c, "Request panicked", "error", err, "stack", string(debug.Stack()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
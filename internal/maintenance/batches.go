@@ -0,0 +1,25 @@
+package maintenance
+
+import (
+	"context"
+	"time"
+)
+
+// Pause between batches so other writers get a chance at the table
+const batchPause = 100 * time.Millisecond
+
+// Calls batch until it reports that it is done, pausing between calls
+func inBatches(ctx context.Context, batch func() (bool, error)) error {
+	for {
+		more, err := batch()
+		if err != nil || !more {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(batchPause):
+		}
+	}
+}
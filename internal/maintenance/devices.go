@@ -0,0 +1,61 @@
+package maintenance
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/internal/metrics"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+const DefaultReapBatchSize = 100
+
+// DeviceReaper deletes devices which have not been seen for longer than MaxAge.
+// Chains left without any devices are deleted together with their data.
+type DeviceReaper struct {
+	repo      repository.Repository
+	maxAge    time.Duration
+	batchSize int32
+	metrics   *metrics.Metrics
+}
+
+// ReapResult describes a single run of the reaper
+type ReapResult struct {
+	NotSeenSince   time.Time `json:"notSeenSince"`
+	DevicesRemoved int64     `json:"devicesRemoved"`
+	UsersRemoved   int64     `json:"usersRemoved"`
+}
+
+func NewDeviceReaper(repo repository.Repository, maxAge time.Duration, m *metrics.Metrics) *DeviceReaper {
+	return &DeviceReaper{
+		repo:      repo,
+		maxAge:    maxAge,
+		batchSize: DefaultReapBatchSize,
+		metrics:   m,
+	}
+}
+
+// ReapOnce deletes all devices not seen for MaxAge, one batch at a time
+func (r *DeviceReaper) ReapOnce(ctx context.Context) (ReapResult, error) {
+	startedAt := time.Now()
+	result := ReapResult{
+		NotSeenSince: startedAt.Add(-r.maxAge),
+	}
+
+	err := inBatches(ctx, func() (bool, error) {
+		reaped, err := r.repo.ReapDevices(ctx, result.NotSeenSince, r.batchSize)
+		result.DevicesRemoved += reaped.Devices
+		result.UsersRemoved += reaped.Users
+		r.metrics.DevicesReaped(reaped.Devices, reaped.Users)
+		return reaped.Devices >= int64(r.batchSize), err
+	})
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Reaping devices failed", "devices_removed", result.DevicesRemoved, "error", err)
+	} else {
+		slog.InfoContext(ctx, "Reaped devices", "devices_removed", result.DevicesRemoved, "chains_removed", result.UsersRemoved, "not_seen_since", result.NotSeenSince, "duration", time.Since(startedAt))
+	}
+
+	return result, err
+}
@@ -0,0 +1,61 @@
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/internal/metrics"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+type reapRepository struct {
+	repository.Repository
+	results []repository.ReapedDevices
+	err     error
+	calls   int
+}
+
+func (r *reapRepository) ReapDevices(ctx context.Context, notSeenSince time.Time, batchSize int32) (repository.ReapedDevices, error) {
+	if r.calls >= len(r.results) {
+		return repository.ReapedDevices{}, r.err
+	}
+	result := r.results[r.calls]
+	r.calls++
+	return result, nil
+}
+
+func TestReapOnceSumsBatches(t *testing.T) {
+	repo := &reapRepository{
+		results: []repository.ReapedDevices{
+			{Devices: 2, Users: 1},
+			{Devices: 1, Users: 0},
+		},
+	}
+	m := metrics.New()
+	reaper := NewDeviceReaper(repo, time.Hour, m)
+	reaper.batchSize = 2
+
+	result, err := reaper.ReapOnce(context.Background())
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.DevicesRemoved != 3 || result.UsersRemoved != 1 {
+		t.Errorf("removed %d devices and %d users; want 3 and 1", result.DevicesRemoved, result.UsersRemoved)
+	}
+	assertMetric(t, m, "feeder_sync_devices_reaped_total 3")
+	assertMetric(t, m, "feeder_sync_chains_reaped_total 1")
+}
+
+func TestReapOnceStopsOnError(t *testing.T) {
+	repo := &reapRepository{err: errors.New("boom")}
+	reaper := NewDeviceReaper(repo, time.Hour, metrics.New())
+
+	_, err := reaper.ReapOnce(context.Background())
+
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,59 @@
+package maintenance
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/internal/metrics"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+const DefaultPruneBatchSize = 1000
+
+// ReadMarkPruner deletes read marks which were read longer ago than MaxAge.
+// Rows are deleted in small batches so no lock is held for long.
+type ReadMarkPruner struct {
+	repo      repository.Repository
+	maxAge    time.Duration
+	batchSize int32
+	metrics   *metrics.Metrics
+}
+
+// PruneResult describes a single run of the pruner
+type PruneResult struct {
+	ReadBefore  time.Time `json:"readBefore"`
+	RowsRemoved int64     `json:"rowsRemoved"`
+}
+
+func NewReadMarkPruner(repo repository.Repository, maxAge time.Duration, m *metrics.Metrics) *ReadMarkPruner {
+	return &ReadMarkPruner{
+		repo:      repo,
+		maxAge:    maxAge,
+		batchSize: DefaultPruneBatchSize,
+		metrics:   m,
+	}
+}
+
+// PruneOnce deletes all read marks older than MaxAge, one batch at a time
+func (p *ReadMarkPruner) PruneOnce(ctx context.Context) (PruneResult, error) {
+	startedAt := time.Now()
+	result := PruneResult{
+		ReadBefore: startedAt.Add(-p.maxAge),
+	}
+
+	err := inBatches(ctx, func() (bool, error) {
+		removed, err := p.repo.PruneReadMarks(ctx, result.ReadBefore, p.batchSize)
+		result.RowsRemoved += removed
+		p.metrics.ReadMarksPruned(removed)
+		return removed >= int64(p.batchSize), err
+	})
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Pruning read marks failed", "removed", result.RowsRemoved, "error", err)
+	} else {
+		slog.InfoContext(ctx, "Pruned read marks", "removed", result.RowsRemoved, "read_before", result.ReadBefore, "duration", time.Since(startedAt))
+	}
+
+	return result, err
+}
@@ -0,0 +1,60 @@
+package maintenance
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/internal/metrics"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+// Fails unless the metrics contain the line
+func assertMetric(t *testing.T, m *metrics.Metrics, line string) {
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), "\n"+line+"\n") {
+		t.Errorf("metrics lack %q", line)
+	}
+}
+
+type pruneRepository struct {
+	repository.Repository
+	remaining  int64
+	calls      int
+	readBefore time.Time
+}
+
+func (r *pruneRepository) PruneReadMarks(ctx context.Context, readBefore time.Time, batchSize int32) (int64, error) {
+	r.calls++
+	r.readBefore = readBefore
+	removed := min(r.remaining, int64(batchSize))
+	r.remaining -= removed
+	return removed, nil
+}
+
+func TestPruneOnceRemovesInBatches(t *testing.T) {
+	repo := &pruneRepository{remaining: 25}
+	m := metrics.New()
+	pruner := NewReadMarkPruner(repo, 24*time.Hour, m)
+	pruner.batchSize = 10
+
+	result, err := pruner.PruneOnce(context.Background())
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.RowsRemoved != 25 {
+		t.Errorf("RowsRemoved = %d; want 25", result.RowsRemoved)
+	}
+	if repo.calls != 3 {
+		t.Errorf("calls = %d; want 3", repo.calls)
+	}
+	assertMetric(t, m, "feeder_sync_readmarks_pruned_total 25")
+	if !result.ReadBefore.Equal(repo.readBefore) {
+		t.Errorf("pruned read marks read before %s; want %s", repo.readBefore, result.ReadBefore)
+	}
+}
@@ -0,0 +1,210 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+const namespace = "feeder_sync"
+
+// Route label of requests which matched no route
+const unmatchedRoute = "unmatched"
+
+// Metrics of a single server. Each has its own registry, so several can exist side by side.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	queryTracer  *QueryTracer
+
+	chainsCreated  prometheus.Counter
+	devicesJoined  prometheus.Counter
+	devicesLeft    prometheus.Counter
+	chainsMerged   prometheus.Counter
+	readMarksSaved prometheus.Counter
+	readMarksSent  prometheus.Counter
+	feedsUploads   prometheus.Counter
+	etagRequests   *prometheus.CounterVec
+
+	readMarksPruned prometheus.Counter
+	devicesReaped   prometheus.Counter
+	chainsReaped    prometheus.Counter
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route and status.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time to handle HTTP requests by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		queryTracer: newQueryTracer(),
+		chainsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "chains_created_total",
+			Help:      "Sync chains created.",
+		}),
+		devicesJoined: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "devices_joined_total",
+			Help:      "Devices which joined an existing sync chain.",
+		}),
+		devicesLeft: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "devices_left_total",
+			Help:      "Devices which left, or were removed from, a sync chain.",
+		}),
+		chainsMerged: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "chains_merged_total",
+			Help:      "Sync chains merged into another chain.",
+		}),
+		readMarksSaved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "readmarks_received_total",
+			Help:      "Read marks sent by devices.",
+		}),
+		readMarksSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "readmarks_sent_total",
+			Help:      "Read marks sent to devices.",
+		}),
+		feedsUploads: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "feeds_uploads_total",
+			Help:      "Feeds uploaded by devices.",
+		}),
+		etagRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "etag_requests_total",
+			Help:      "Conditional requests by resource, and whether the ETag matched.",
+		}, []string{"resource", "result"}),
+		readMarksPruned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "readmarks_pruned_total",
+			Help:      "Read marks deleted for being older than the retention.",
+		}),
+		devicesReaped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "devices_reaped_total",
+			Help:      "Devices deleted for not being seen within the retention.",
+		}),
+		chainsReaped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "chains_reaped_total",
+			Help:      "Sync chains deleted for being left without devices.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.queryTracer.duration,
+		m.chainsCreated,
+		m.devicesJoined,
+		m.devicesLeft,
+		m.chainsMerged,
+		m.readMarksSaved,
+		m.readMarksSent,
+		m.feedsUploads,
+		m.etagRequests,
+		m.readMarksPruned,
+		m.devicesReaped,
+		m.chainsReaped,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records every request by its route, not its path, to bound the number of series
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		method := c.Request.Method
+		m.httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		m.httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// QueryTracer records the latency of every database query. Set it on the pool config.
+func (m *Metrics) QueryTracer() *QueryTracer {
+	return m.queryTracer
+}
+
+// RegisterPool exposes the statistics of the database pool
+func (m *Metrics) RegisterPool(stats func() repository.PoolStats) {
+	m.registry.MustRegister(&poolCollector{stats: stats})
+}
+
+func (m *Metrics) ChainCreated() {
+	m.chainsCreated.Inc()
+}
+
+func (m *Metrics) DeviceJoined() {
+	m.devicesJoined.Inc()
+}
+
+func (m *Metrics) DeviceLeft() {
+	m.devicesLeft.Inc()
+}
+
+func (m *Metrics) ChainMerged() {
+	m.chainsMerged.Inc()
+}
+
+func (m *Metrics) ReadMarksReceived(count int) {
+	m.readMarksSaved.Add(float64(count))
+}
+
+func (m *Metrics) ReadMarksSent(count int) {
+	m.readMarksSent.Add(float64(count))
+}
+
+func (m *Metrics) ReadMarksPruned(count int64) {
+	m.readMarksPruned.Add(float64(count))
+}
+
+func (m *Metrics) DevicesReaped(devices int64, chains int64) {
+	m.devicesReaped.Add(float64(devices))
+	m.chainsReaped.Add(float64(chains))
+}
+
+func (m *Metrics) FeedsUploaded() {
+	m.feedsUploads.Inc()
+}
+
+// EtagChecked records whether a conditional request for the resource could be answered with 304
+func (m *Metrics) EtagChecked(resource string, matched bool) {
+	result := "miss"
+	if matched {
+		result = "hit"
+	}
+	m.etagRequests.WithLabelValues(resource, result).Inc()
+}
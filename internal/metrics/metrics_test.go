@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scrape returned %d", recorder.Code)
+	}
+	return recorder.Body.String()
+}
+
+func TestMiddlewareLabelsByRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := New()
+	router := gin.New()
+	router.Use(m.Middleware())
+	router.GET("/api/v1/devices/:id", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	for _, path := range []string{"/api/v1/devices/1", "/api/v1/devices/2", "/nowhere"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	body := scrape(t, m)
+	for _, expected := range []string{
+		`feeder_sync_http_requests_total{method="GET",route="/api/v1/devices/:id",status="204"} 2`,
+		`feeder_sync_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("missing %s in:\n%s", expected, body)
+		}
+	}
+}
+
+func TestPoolStatsAreReadOnScrape(t *testing.T) {
+	m := New()
+	m.RegisterPool(func() repository.PoolStats {
+		return repository.PoolStats{AcquiredConns: 3, MaxConns: 4}
+	})
+
+	body := scrape(t, m)
+	for _, expected := range []string{
+		"feeder_sync_db_pool_acquired_connections 3",
+		"feeder_sync_db_pool_max_connections 4",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("missing %s", expected)
+		}
+	}
+}
+
+func TestDomainCounters(t *testing.T) {
+	m := New()
+	m.ChainCreated()
+	m.ReadMarksReceived(5)
+	m.EtagChecked("feeds", true)
+	m.EtagChecked("feeds", false)
+
+	body := scrape(t, m)
+	for _, expected := range []string{
+		"feeder_sync_chains_created_total 1",
+		"feeder_sync_readmarks_received_total 5",
+		`feeder_sync_etag_requests_total{resource="feeds",result="hit"} 1`,
+		`feeder_sync_etag_requests_total{resource="feeds",result="miss"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("missing %s", expected)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+var (
+	poolAcquiredDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "db_pool", "acquired_connections"),
+		"Connections currently in use.", nil, nil,
+	)
+	poolIdleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "db_pool", "idle_connections"),
+		"Connections currently idle.", nil, nil,
+	)
+	poolTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "db_pool", "total_connections"),
+		"Connections currently open.", nil, nil,
+	)
+	poolMaxDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "db_pool", "max_connections"),
+		"Maximum size of the pool.", nil, nil,
+	)
+	poolEmptyAcquireDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "db_pool", "empty_acquire_total"),
+		"Acquires which had to wait for a connection.", nil, nil,
+	)
+	poolAcquireDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "db_pool", "acquire_duration_seconds_total"),
+		"Time spent acquiring connections.", nil, nil,
+	)
+)
+
+// Reads the statistics when scraped, rather than polling them
+type poolCollector struct {
+	stats func() repository.PoolStats
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredDesc
+	ch <- poolIdleDesc
+	ch <- poolTotalDesc
+	ch <- poolMaxDesc
+	ch <- poolEmptyAcquireDesc
+	ch <- poolAcquireDurationDesc
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := p.stats()
+	ch <- prometheus.MustNewConstMetric(poolAcquiredDesc, prometheus.GaugeValue, float64(stats.AcquiredConns))
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.IdleConns))
+	ch <- prometheus.MustNewConstMetric(poolTotalDesc, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(poolMaxDesc, prometheus.GaugeValue, float64(stats.MaxConns))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquireDesc, prometheus.CounterValue, float64(stats.EmptyAcquireCount))
+	ch <- prometheus.MustNewConstMetric(poolAcquireDurationDesc, prometheus.CounterValue, stats.AcquireDuration.Seconds())
+}
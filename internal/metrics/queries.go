@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+// QueryTracer is a pgx.QueryTracer recording query latencies by sqlc query name
+type QueryTracer struct {
+	duration *prometheus.HistogramVec
+}
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	name  string
+	start time.Time
+}
+
+func newQueryTracer() *QueryTracer {
+	return &QueryTracer{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Time to run database queries by name and outcome.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"query", "outcome"}),
+	}
+}
+
+func (t *QueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, queryStart{
+		name:  repository.QueryName(data.SQL),
+		start: time.Now(),
+	})
+}
+
+func (t *QueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	started, ok := ctx.Value(queryStartKey{}).(queryStart)
+	if !ok {
+		return
+	}
+
+	outcome := "ok"
+	if data.Err != nil && data.Err != pgx.ErrNoRows {
+		outcome = "error"
+	}
+	t.duration.WithLabelValues(started.name, outcome).Observe(time.Since(started.start).Seconds())
+}
@@ -1,108 +1,163 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/spacecowboy/feeder-sync/build/gen/db"
+	"github.com/spacecowboy/feeder-sync/internal/events"
+	"github.com/spacecowboy/feeder-sync/internal/problems"
 	"github.com/spacecowboy/feeder-sync/internal/repository"
 )
 
-// Gin gonic middleware in this file
+// Gin gonic middleware in this file.
+// They return without calling c.Next(), so that each can be traced on its own.
 
+// Default basic auth credentials, as built into the app
 const (
 	HARDCODED_USER     = "feeder_user"
 	HARDCODED_PASSWORD = "feeder_secret_1234"
-	// Used by clients
-	DEVICE_NOT_REGISTERED = "Device not registered"
 )
 
-func AssertBasicAuth() gin.HandlerFunc {
+func abortUnauthorized(c *gin.Context, status int) {
+	problems.Abort(c, problems.New(status, problems.Unauthorized, "Unauthorized"))
+}
+
+func AssertBasicAuth(expectedUser string, expectedPassword string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		user, password, ok := c.Request.BasicAuth()
-		if !ok || user != HARDCODED_USER || password != HARDCODED_PASSWORD {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(expectedUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) != 1 {
+			abortUnauthorized(c, http.StatusUnauthorized)
 			return
 		}
-		c.Next()
 	}
 }
 
+// Admin endpoints require "Authorization: Bearer <token>".
+// With an empty token, admin endpoints are disabled entirely.
+func AssertAdminToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if !HasBearerToken(c, token) {
+			abortUnauthorized(c, http.StatusUnauthorized)
+			return
+		}
+	}
+}
+
+// Returns true if the request carries "Authorization: Bearer <token>". Never true for an empty token.
+func HasBearerToken(c *gin.Context, token string) bool {
+	bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
 func AssertRegisteredUser(repo repository.Repository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		syncCode := c.GetHeader("X-FEEDER-ID")
-		userIdString := c.GetHeader("X-FEEDER-USER-ID")
-
-		if userIdString != "" {
-			userId, err := uuid.Parse(userIdString)
-			if err != nil {
-				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Unauthorized"})
-				return
-			}
-
-			user, err := repo.GetUserByUserId(c, userId)
-			if err != nil {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-				return
-			}
-
-			c.Set("user", user)
-		} else if syncCode != "" {
-			user, err := repo.GetUserBySyncCode(c, syncCode)
-			if err != nil {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-				return
-			}
-
-			c.Set("user", user)
+		userId, syncCode, ok := userCredentials(c)
+		if !ok {
+			return
+		}
+
+		var user db.User
+		var err error
+		if userId != nil {
+			user, err = repo.GetUserByUserId(c, *userId)
 		} else {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			user, err = repo.GetUserBySyncCode(c, syncCode)
+		}
+		if errors.Is(err, repository.ErrNoSuchUser) {
+			abortUnauthorized(c, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			problems.AbortWithError(c, err)
 			return
 		}
 
-		c.Next()
+		c.Set("user", user)
 	}
 }
 
-func AssertRegisteredDevice(repo repository.Repository) gin.HandlerFunc {
+// Records that a device made a request
+type LastSeenRecorder interface {
+	Seen(device db.Device)
+}
+
+// Resolves the user and the device in a single repository call, and records the device as seen
+func AssertRegisteredDevice(repo repository.Repository, lastSeen LastSeenRecorder) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		userId, syncCode, ok := userCredentials(c)
+		if !ok {
+			return
+		}
+
 		// This is the legacy device id (int64)
 		legacyDeviceIdString := c.GetHeader("X-FEEDER-DEVICE-ID")
 
 		if legacyDeviceIdString == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			abortUnauthorized(c, http.StatusUnauthorized)
 			return
 		}
 
 		legacyDeviceId, err := strconv.ParseInt(legacyDeviceIdString, 10, 64)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Unauthorized"})
+			abortUnauthorized(c, http.StatusBadRequest)
 			return
 		}
 
-		user := c.MustGet("user").(db.User)
-		device, err := repo.GetDeviceWithLegacyId(c, user, legacyDeviceId)
-
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": DEVICE_NOT_REGISTERED, "value": legacyDeviceId})
+		userDevice, err := repo.AuthenticateDevice(c, repository.DeviceCredentials{
+			UserId:         userId,
+			SyncCode:       syncCode,
+			LegacyDeviceId: legacyDeviceId,
+		})
+		switch {
+		case errors.Is(err, repository.ErrNoSuchUser):
+			abortUnauthorized(c, http.StatusUnauthorized)
+			return
+		case errors.Is(err, repository.ErrNoSuchDevice):
+			problems.Abort(c, problems.New(http.StatusUnauthorized, problems.DeviceNotRegistered, "Device not registered").
+				With("value", legacyDeviceId))
+			return
+		case err != nil:
+			problems.AbortWithError(c, err)
 			return
 		}
 
-		c.Set("device", device)
-		c.Next()
+		lastSeen.Seen(userDevice.Device)
+
+		c.Set("user", userDevice.User)
+		c.Set("device", userDevice.Device)
+		// Changes made during this request are not notified back to the same device
+		c.Request = c.Request.WithContext(events.WithSourceDevice(c.Request.Context(), userDevice.Device.DbID))
 	}
 }
 
-func UpdateLastSeenForDevice(repo repository.Repository) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		device := c.MustGet("device").(db.Device)
-
-		if err := repo.UpdateLastSeenForDevice(c, device); err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-			return
+// Reads the user id, or the sync code, from the headers. Aborts the request if neither is valid.
+func userCredentials(c *gin.Context) (*uuid.UUID, string, bool) {
+	if userIdString := c.GetHeader("X-FEEDER-USER-ID"); userIdString != "" {
+		userId, err := uuid.Parse(userIdString)
+		if err != nil {
+			abortUnauthorized(c, http.StatusBadRequest)
+			return nil, "", false
 		}
-		c.Next()
+		return &userId, "", true
+	}
+
+	if syncCode := c.GetHeader("X-FEEDER-ID"); syncCode != "" {
+		return nil, syncCode, true
 	}
+
+	abortUnauthorized(c, http.StatusUnauthorized)
+	return nil, "", false
 }
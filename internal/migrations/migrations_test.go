@@ -21,3 +21,35 @@ func TestFixDbUrl(t *testing.T) {
 		}
 	}
 }
+
+func TestEveryMigrationHasUpAndDown(t *testing.T) {
+	versions, err := Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	d, err := newSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i, version := range versions {
+		if i > 0 && version <= versions[i-1] {
+			t.Errorf("versions not ascending: %v", versions)
+		}
+		if up, _, err := d.ReadUp(version); err != nil {
+			t.Errorf("version %d has no up migration: %v", version, err)
+		} else {
+			up.Close()
+		}
+		if down, _, err := d.ReadDown(version); err != nil {
+			t.Errorf("version %d has no down migration: %v", version, err)
+		} else {
+			down.Close()
+		}
+	}
+}
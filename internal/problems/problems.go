@@ -0,0 +1,134 @@
+package problems
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+// Error responses are RFC 7807 problem details, with a stable code which clients can act on
+
+const ContentType = "application/problem+json"
+
+// Code identifies a problem. Codes are part of the API and must never change.
+type Code string
+
+const (
+	Unauthorized        Code = "UNAUTHORIZED"
+	DeviceNotRegistered Code = "DEVICE_NOT_REGISTERED"
+	InvalidBody         Code = "INVALID_BODY"
+	MissingDeviceName   Code = "MISSING_DEVICE_NAME"
+	MissingSyncCode     Code = "MISSING_SYNC_CODE"
+	InvalidDeviceId     Code = "INVALID_DEVICE_ID"
+	InvalidSince        Code = "INVALID_SINCE"
+	NoReadMarks         Code = "NO_READ_MARKS"
+	ValueTooLong        Code = "VALUE_TOO_LONG"
+	InvalidPushEndpoint Code = "INVALID_PUSH_ENDPOINT"
+	EtagMismatch        Code = "ETAG_MISMATCH"
+	QuotaExceeded       Code = "QUOTA_EXCEEDED"
+	PayloadTooLarge     Code = "PAYLOAD_TOO_LARGE"
+	NoSuchChain         Code = "NO_SUCH_CHAIN"
+	NoSuchDevice        Code = "NO_SUCH_DEVICE"
+	SameChain           Code = "SAME_CHAIN"
+	NotFound            Code = "NOT_FOUND"
+	Conflict            Code = "CONFLICT"
+	Invalid             Code = "INVALID"
+	Internal            Code = "INTERNAL_ERROR"
+)
+
+// Problem is the body of every error response
+type Problem struct {
+	Status int
+	Code   Code
+	// Short summary. Same for every occurrence of the code.
+	Title string
+	// Explanation specific to this occurrence. Optional.
+	Detail string
+	// Additional members, such as the limit of an exceeded quota
+	Extensions map[string]any
+}
+
+func New(status int, code Code, title string) *Problem {
+	return &Problem{
+		Status: status,
+		Code:   code,
+		Title:  title,
+	}
+}
+
+func (p *Problem) WithDetail(detail string) *Problem {
+	p.Detail = detail
+	return p
+}
+
+func (p *Problem) With(key string, value any) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]any)
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+// URI of the problem type
+func (p *Problem) Type() string {
+	return "urn:feeder-sync:problem:" + strings.ToLower(strings.ReplaceAll(string(p.Code), "_", "-"))
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	body := make(map[string]any, len(p.Extensions)+6)
+	for key, value := range p.Extensions {
+		body[key] = value
+	}
+	body["type"] = p.Type()
+	body["title"] = p.Title
+	body["status"] = p.Status
+	body["code"] = p.Code
+	// Older clients read the title from here
+	body["error"] = p.Title
+	if p.Detail != "" {
+		body["detail"] = p.Detail
+	}
+	return json.Marshal(body)
+}
+
+// Abort ends the request with the problem as response
+func Abort(c *gin.Context, p *Problem) {
+	c.Header("Content-Type", ContentType)
+	c.AbortWithStatusJSON(p.Status, p)
+}
+
+// AbortWithError ends the request with the problem which the error maps to.
+// Unexpected errors are logged, and never shown to the client.
+func AbortWithError(c *gin.Context, err error) {
+	p := FromError(err)
+	if p.Status >= http.StatusInternalServerError {
+		// With the context, so that the line carries the trace id
+		slog.ErrorContext(c, "Request failed", "method", c.Request.Method, "route", c.FullPath(), "error", err)
+	}
+	Abort(c, p)
+}
+
+// FromError maps errors to problems. This is the only place where that happens.
+func FromError(err error) *Problem {
+	switch {
+	case errors.Is(err, repository.ErrNoSuchUser):
+		return New(http.StatusNotFound, NoSuchChain, "No such chain")
+	case errors.Is(err, repository.ErrNoSuchDevice):
+		return New(http.StatusNotFound, NoSuchDevice, "No such device")
+	case errors.Is(err, repository.ErrSameChain):
+		return New(http.StatusBadRequest, SameChain, "Cannot merge a chain into itself")
+	case errors.Is(err, repository.ErrNotFound):
+		return New(http.StatusNotFound, NotFound, "Not found")
+	case errors.Is(err, repository.ErrConflict):
+		return New(http.StatusConflict, Conflict, "Conflict")
+	case errors.Is(err, repository.ErrInvalid):
+		return New(http.StatusBadRequest, Invalid, "Invalid")
+	default:
+		return New(http.StatusInternalServerError, Internal, "Internal server error")
+	}
+}
@@ -0,0 +1,64 @@
+package problems
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+func TestFromError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   Code
+	}{
+		{repository.ErrNoSuchUser, http.StatusNotFound, NoSuchChain},
+		{fmt.Errorf("join: %w", repository.ErrNoSuchUser), http.StatusNotFound, NoSuchChain},
+		{repository.ErrNoSuchDevice, http.StatusNotFound, NoSuchDevice},
+		{repository.ErrSameChain, http.StatusBadRequest, SameChain},
+		{repository.ErrNoFeeds, http.StatusNotFound, NotFound},
+		{errors.New("connection refused"), http.StatusInternalServerError, Internal},
+	}
+
+	for _, test := range tests {
+		p := FromError(test.err)
+		if p.Status != test.status || p.Code != test.code {
+			t.Errorf("FromError(%v) = %d %s; want %d %s", test.err, p.Status, p.Code, test.status, test.code)
+		}
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	p := New(http.StatusUnprocessableEntity, QuotaExceeded, "Quota exceeded").With("limit", 50)
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		"type":   "urn:feeder-sync:problem:quota-exceeded",
+		"title":  "Quota exceeded",
+		"status": float64(422),
+		"code":   "QUOTA_EXCEEDED",
+		"error":  "Quota exceeded",
+		"limit":  float64(50),
+	}
+	if len(body) != len(want) {
+		t.Errorf("body = %v; want %v", body, want)
+	}
+	for key, value := range want {
+		if body[key] != value {
+			t.Errorf("body[%q] = %v; want %v", key, body[key], value)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package push
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when an endpoint resolves to an address which is not public
+var ErrForbiddenAddress = errors.New("push: endpoint address is not public")
+
+const dialTimeout = 5 * time.Second
+
+// Carrier-grade NAT, which IsPrivate doesn't cover
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Endpoints are chosen by clients, so must not make the server call into its own network
+func isPublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() &&
+		!ip.IsUnspecified() &&
+		!ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// Runs after names are resolved, so a public name resolving to a private address is refused as well
+func refuseNonPublicAddresses(network string, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddress(addrPort.Addr()) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// Client which only connects to public addresses. Proxies are not used, as they would
+// make the connection on our behalf.
+func newEndpointClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+		Control: refuseNonPublicAddresses,
+	}
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// IsAllowedHost reports whether pushes may be sent to the host of an endpoint.
+// Hosts which are obviously not public, like localhost or private addresses, are never allowed.
+// If allowedHosts is not empty, the host must be one of them or a subdomain of one.
+func IsAllowedHost(host string, allowedHosts []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil && !isPublicAddress(ip) {
+		return false
+	}
+
+	if len(allowedHosts) == 0 {
+		return true
+	}
+	for _, allowed := range allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
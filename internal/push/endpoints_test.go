@@ -0,0 +1,81 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/spacecowboy/feeder-sync/build/gen/db"
+	"github.com/spacecowboy/feeder-sync/internal/events"
+)
+
+func TestIsAllowedHost(t *testing.T) {
+	tests := []struct {
+		host         string
+		allowedHosts []string
+		want         bool
+	}{
+		{"push.example.com", nil, true},
+		{"93.184.215.14", nil, true},
+		{"2606:2800:21f:cb07:6820:80da:af6b:8b2c", nil, true},
+		{"localhost", nil, false},
+		{"LOCALHOST.", nil, false},
+		{"api.localhost", nil, false},
+		{"127.0.0.1", nil, false},
+		{"10.0.0.1", nil, false},
+		{"172.16.5.4", nil, false},
+		{"192.168.1.1", nil, false},
+		{"169.254.169.254", nil, false},
+		{"100.64.0.1", nil, false},
+		{"0.0.0.0", nil, false},
+		{"::1", nil, false},
+		{"fe80::1", nil, false},
+		{"fd00::1", nil, false},
+		{"::ffff:127.0.0.1", nil, false},
+		{"ntfy.sh", []string{"ntfy.sh", "push.example.com"}, true},
+		{"eu.push.example.com", []string{"ntfy.sh", "push.example.com"}, true},
+		{"evil.com", []string{"ntfy.sh", "push.example.com"}, false},
+		{"notntfy.sh", []string{"ntfy.sh"}, false},
+		{"10.0.0.1", []string{"10.0.0.1"}, false},
+	}
+	for _, test := range tests {
+		if got := IsAllowedHost(test.host, test.allowedHosts); got != test.want {
+			t.Errorf("IsAllowedHost(%q, %v) = %v; want %v", test.host, test.allowedHosts, got, test.want)
+		}
+	}
+}
+
+func TestEndpointClientRefusesLoopback(t *testing.T) {
+	provider, received := newProvider(t, http.StatusCreated)
+
+	request, err := http.NewRequest(http.MethodPost, provider.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newEndpointClient().Do(request)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("err = %v; want %v", err, ErrForbiddenAddress)
+	}
+	if len(*received) != 0 {
+		t.Errorf("provider got %d pushes; want 0", len(*received))
+	}
+}
+
+func TestPushUnregistersEndpointWhichIsNotPublic(t *testing.T) {
+	provider, received := newProvider(t, http.StatusCreated)
+	repo := &pushRepository{
+		endpoints: []db.GetPushEndpointsRow{{DbID: 2, PushEndpoint: provider.URL}},
+	}
+	pusher := NewPusher(repo)
+
+	pusher.pushEvent(context.Background(), events.Event{UserDbID: 1, Kind: events.DevicesChanged})
+	pusher.wg.Wait()
+
+	if len(*received) != 0 {
+		t.Errorf("provider got %d pushes; want 0", len(*received))
+	}
+	if len(repo.cleared) != 1 || repo.cleared[0] != provider.URL {
+		t.Errorf("cleared = %v; want %v", repo.cleared, []string{provider.URL})
+	}
+}
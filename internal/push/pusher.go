@@ -0,0 +1,201 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/internal/events"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+const (
+	DefaultMaxAttempts    = 5
+	DefaultInitialBackoff = 2 * time.Second
+	// Number of events waiting to be pushed before new ones are dropped
+	queueSize = 256
+	// Number of pushes in flight at once
+	maxConcurrentPushes = 16
+	requestTimeout      = 10 * time.Second
+	// Longest Retry-After honoured, as a waiting push holds one of the slots
+	maxRetryAfter = 5 * time.Minute
+	// Seconds the push provider should keep an undelivered message
+	messageTTL = "86400"
+)
+
+// Message is the body POSTed to a UnifiedPush endpoint.
+// It only wakes the device up, which then syncs as usual.
+type Message struct {
+	Type string `json:"type"`
+}
+
+// Pusher wakes up devices with registered UnifiedPush endpoints when
+// another device in the same chain changes something
+type Pusher struct {
+	repo           repository.Repository
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+
+	queue    chan events.Event
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewPusher(repo repository.Repository) *Pusher {
+	return &Pusher{
+		repo:           repo,
+		client:         newEndpointClient(),
+		maxAttempts:    DefaultMaxAttempts,
+		initialBackoff: DefaultInitialBackoff,
+		queue:          make(chan events.Event, queueSize),
+		inFlight:       make(chan struct{}, maxConcurrentPushes),
+	}
+}
+
+// Notify queues the event for pushing. Never blocks.
+func (p *Pusher) Notify(event events.Event) {
+	select {
+	case p.queue <- event:
+	default:
+		slog.Warn("Push queue is full, dropping event", "kind", event.Kind, "user_db_id", event.UserDbID)
+	}
+}
+
+// Run pushes queued events until the context is cancelled.
+// Waits for pushes in flight before returning.
+func (p *Pusher) Run(ctx context.Context) {
+	defer p.wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-p.queue:
+			p.pushEvent(ctx, event)
+		}
+	}
+}
+
+func (p *Pusher) pushEvent(ctx context.Context, event events.Event) {
+	endpoints, err := p.repo.GetPushEndpoints(ctx, event.UserDbID, event.SourceDeviceDbID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get push endpoints", "user_db_id", event.UserDbID, "error", err)
+		return
+	}
+
+	body, err := json.Marshal(Message{Type: string(event.Kind)})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode push message", "error", err)
+		return
+	}
+
+	for _, endpoint := range endpoints {
+		select {
+		case <-ctx.Done():
+			return
+		case p.inFlight <- struct{}{}:
+		}
+
+		p.wg.Add(1)
+		go func(deviceDbID int64, endpoint string) {
+			defer p.wg.Done()
+			defer func() { <-p.inFlight }()
+			p.deliver(ctx, deviceDbID, endpoint, body)
+		}(endpoint.DbID, endpoint.PushEndpoint)
+	}
+}
+
+// Posts the message, retrying with exponential backoff, or after the delay the provider asks for.
+// Endpoints which the push provider says are gone, or which aren't public, are unregistered.
+func (p *Pusher) deliver(ctx context.Context, deviceDbID int64, endpoint string, body []byte) {
+	backoff := p.initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		status, retryAfter, err := p.post(ctx, endpoint, body)
+
+		switch {
+		case err == nil && status >= 200 && status < 300:
+			return
+		case status == http.StatusNotFound || status == http.StatusGone:
+			slog.InfoContext(ctx, "Push endpoint has expired, unregistering it", "device_db_id", deviceDbID)
+			p.unregister(ctx, deviceDbID, endpoint)
+			return
+		case errors.Is(err, ErrForbiddenAddress):
+			slog.WarnContext(ctx, "Push endpoint is not public, unregistering it", "device_db_id", deviceDbID)
+			p.unregister(ctx, deviceDbID, endpoint)
+			return
+		case err == nil && status < 500 && status != http.StatusTooManyRequests:
+			slog.WarnContext(ctx, "Push was rejected", "device_db_id", deviceDbID, "status", status)
+			return
+		}
+
+		if attempt >= p.maxAttempts {
+			slog.WarnContext(ctx, "Giving up push", "device_db_id", deviceDbID, "attempts", attempt, "status", status, "error", err)
+			return
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+func (p *Pusher) unregister(ctx context.Context, deviceDbID int64, endpoint string) {
+	if err := p.repo.ClearPushEndpoint(ctx, deviceDbID, endpoint); err != nil {
+		slog.ErrorContext(ctx, "Failed to unregister push endpoint", "device_db_id", deviceDbID, "error", err)
+	}
+}
+
+// Returns the response status and the requested retry delay, or an error if no response was received
+func (p *Pusher) post(ctx context.Context, endpoint string, body []byte) (int, time.Duration, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad push endpoint: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("TTL", messageTTL)
+	request.Header.Set("Urgency", "normal")
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer response.Body.Close()
+
+	var retryAfter time.Duration
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		retryAfter = parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+	}
+	return response.StatusCode, retryAfter, nil
+}
+
+// Parses a Retry-After header, which holds either seconds or a date.
+// Returns zero if the header is missing or invalid, and at most maxRetryAfter.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = date.Sub(now)
+	}
+	return min(max(delay, 0), maxRetryAfter)
+}
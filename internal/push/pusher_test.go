@@ -0,0 +1,171 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/build/gen/db"
+	"github.com/spacecowboy/feeder-sync/internal/events"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+)
+
+type pushRepository struct {
+	repository.Repository
+	endpoints []db.GetPushEndpointsRow
+
+	mutex   sync.Mutex
+	cleared []string
+}
+
+func (r *pushRepository) GetPushEndpoints(ctx context.Context, userDbID int64, exceptDeviceDbID int64) ([]db.GetPushEndpointsRow, error) {
+	return r.endpoints, nil
+}
+
+func (r *pushRepository) ClearPushEndpoint(ctx context.Context, deviceDbID int64, endpoint string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cleared = append(r.cleared, endpoint)
+	return nil
+}
+
+// Stand-in for a push provider which answers with the given statuses in order
+func newProvider(t *testing.T, statuses ...int) (*httptest.Server, *[]Message) {
+	var mutex sync.Mutex
+	var received []Message
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message Message
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Errorf("bad push body: %v", err)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, message)
+		w.WriteHeader(statuses[min(len(received), len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &received
+}
+
+func newTestPusher(repo repository.Repository) *Pusher {
+	pusher := NewPusher(repo)
+	pusher.initialBackoff = time.Millisecond
+	// Providers listen on loopback, which the default client refuses
+	pusher.client = &http.Client{Timeout: requestTimeout}
+	return pusher
+}
+
+func TestPushRetriesUntilDelivered(t *testing.T) {
+	provider, received := newProvider(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusCreated)
+	repo := &pushRepository{
+		endpoints: []db.GetPushEndpointsRow{{DbID: 2, PushEndpoint: provider.URL}},
+	}
+	pusher := newTestPusher(repo)
+
+	pusher.pushEvent(context.Background(), events.Event{UserDbID: 1, Kind: events.ReadMarksChanged, SourceDeviceDbID: 1})
+	pusher.wg.Wait()
+
+	if len(*received) != 3 {
+		t.Fatalf("provider got %d pushes; want 3", len(*received))
+	}
+	if got := (*received)[2].Type; got != "readmarks" {
+		t.Errorf("Type = %q; want %q", got, "readmarks")
+	}
+	if len(repo.cleared) != 0 {
+		t.Errorf("endpoint was unregistered: %v", repo.cleared)
+	}
+}
+
+func TestPushGivesUpAfterMaxAttempts(t *testing.T) {
+	provider, received := newProvider(t, http.StatusInternalServerError)
+	repo := &pushRepository{
+		endpoints: []db.GetPushEndpointsRow{{DbID: 2, PushEndpoint: provider.URL}},
+	}
+	pusher := newTestPusher(repo)
+	pusher.maxAttempts = 3
+
+	pusher.pushEvent(context.Background(), events.Event{UserDbID: 1, Kind: events.FeedsChanged})
+	pusher.wg.Wait()
+
+	if len(*received) != 3 {
+		t.Errorf("provider got %d pushes; want 3", len(*received))
+	}
+}
+
+func TestPushUnregistersExpiredEndpoint(t *testing.T) {
+	provider, received := newProvider(t, http.StatusGone)
+	repo := &pushRepository{
+		endpoints: []db.GetPushEndpointsRow{{DbID: 2, PushEndpoint: provider.URL}},
+	}
+	pusher := newTestPusher(repo)
+
+	pusher.pushEvent(context.Background(), events.Event{UserDbID: 1, Kind: events.DevicesChanged})
+	pusher.wg.Wait()
+
+	if len(*received) != 1 {
+		t.Errorf("provider got %d pushes; want 1", len(*received))
+	}
+	if len(repo.cleared) != 1 || repo.cleared[0] != provider.URL {
+		t.Errorf("cleared = %v; want [%s]", repo.cleared, provider.URL)
+	}
+}
+
+func TestPushWaitsForRetryAfter(t *testing.T) {
+	var mutex sync.Mutex
+	var attempts []time.Time
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(provider.Close)
+	repo := &pushRepository{
+		endpoints: []db.GetPushEndpointsRow{{DbID: 2, PushEndpoint: provider.URL}},
+	}
+	pusher := newTestPusher(repo)
+
+	pusher.pushEvent(context.Background(), events.Event{UserDbID: 1, Kind: events.ReadMarksChanged})
+	pusher.wg.Wait()
+
+	if len(attempts) != 2 {
+		t.Fatalf("provider got %d pushes; want 2", len(attempts))
+	}
+	if waited := attempts[1].Sub(attempts[0]); waited < time.Second {
+		t.Errorf("retried after %s; want at least 1s", waited)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"garbage", 0},
+		{"-5", 0},
+		{"30", 30 * time.Second},
+		{"86400", maxRetryAfter},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, test := range tests {
+		if got := parseRetryAfter(test.header, now); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s; want %s", test.header, got, test.want)
+		}
+	}
+}
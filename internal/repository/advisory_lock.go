@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spacecowboy/feeder-sync/build/gen/db"
+)
+
+// AdvisoryLock is a Postgres session level advisory lock.
+// While held, a connection is kept out of the pool since the lock belongs to the session.
+// If the connection is lost, so is the lock.
+type AdvisoryLock struct {
+	pool *pgxpool.Pool
+	key  int64
+	// Returned on every acquire, when the lock can't be used
+	err error
+
+	mutex sync.Mutex
+	conn  *pgxpool.Conn
+}
+
+// The lock belongs to a session, so one made inside WithTx fails to acquire
+// instead of outliving the transaction.
+func (r *PostgresRepository) NewAdvisoryLock(key int64) *AdvisoryLock {
+	lock := &AdvisoryLock{
+		pool: r.pool,
+		key:  key,
+	}
+	if r.tx != nil {
+		lock.err = errBoundToTx
+	}
+	return lock
+}
+
+// TryAcquire returns true if the lock is held by this process after the call.
+// Never blocks waiting for another holder of the lock.
+func (l *AdvisoryLock) TryAcquire(ctx context.Context) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.err != nil {
+		return false, l.err
+	}
+
+	if l.conn != nil {
+		if err := l.conn.Ping(ctx); err == nil {
+			return true, nil
+		}
+		slog.WarnContext(ctx, "Lost connection holding advisory lock", "key", l.key)
+		l.destroyConn(ctx)
+	}
+
+	conn, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	acquired, err := db.New(conn).TryAdvisoryLock(ctx, l.key)
+	if err != nil || !acquired {
+		conn.Release()
+		return false, err
+	}
+
+	l.conn = conn
+	return true, nil
+}
+
+// Acquire blocks until the lock is held by this process, or the context is done
+func (l *AdvisoryLock) Acquire(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	if l.conn != nil {
+		return nil
+	}
+
+	conn, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := db.New(conn).AdvisoryLock(ctx, l.key); err != nil {
+		// The lock may be granted even if the wait was cancelled
+		_ = conn.Conn().Close(context.Background())
+		conn.Release()
+		return err
+	}
+
+	l.conn = conn
+	return nil
+}
+
+// Release gives up the lock if held. Safe to call even if not held.
+func (l *AdvisoryLock) Release(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+
+	if _, err := db.New(l.conn).AdvisoryUnlock(ctx, l.key); err != nil {
+		// Closing the session is the only other way to release the lock
+		l.destroyConn(ctx)
+		return err
+	}
+
+	l.conn.Release()
+	l.conn = nil
+	return nil
+}
+
+// Closes the connection instead of returning it to the pool
+func (l *AdvisoryLock) destroyConn(ctx context.Context) {
+	_ = l.conn.Conn().Close(ctx)
+	l.conn.Release()
+	l.conn = nil
+}
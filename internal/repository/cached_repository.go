@@ -0,0 +1,238 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spacecowboy/feeder-sync/build/gen/db"
+	"github.com/spacecowboy/feeder-sync/internal/cache"
+	"github.com/spacecowboy/feeder-sync/internal/events"
+)
+
+const (
+	DefaultCacheTTL = 30 * time.Second
+	// Per cache. Users and devices are cached separately.
+	DefaultCacheSize = 10_000
+)
+
+type deviceCacheKey struct {
+	userDbID       int64
+	legacyDeviceId int64
+}
+
+// CachedRepository keeps users and devices looked up during authentication for a short while.
+// Entries of a user are dropped whenever its devices change, be it through this repository
+// or, once passed to Invalidate, through change notifications from any instance.
+type CachedRepository struct {
+	Repository
+	usersByUserId   *cache.Cache[uuid.UUID, db.User]
+	usersBySyncCode *cache.Cache[string, db.User]
+	devices         *cache.Cache[deviceCacheKey, db.Device]
+	// Set inside transactions, where lookups must see uncommitted changes.
+	// Users invalidated in the transaction are invalidated again once it is done.
+	bypass          bool
+	invalidatedInTx *[]int64
+}
+
+// NewCachedRepository caches up to size users and devices for ttl. A zero ttl disables the cache.
+func NewCachedRepository(repo Repository, size int, ttl time.Duration) *CachedRepository {
+	return &CachedRepository{
+		Repository:      repo,
+		usersByUserId:   cache.New[uuid.UUID, db.User](size, ttl),
+		usersBySyncCode: cache.New[string, db.User](size, ttl),
+		devices:         cache.New[deviceCacheKey, db.Device](size, ttl),
+	}
+}
+
+// Invalidate drops cached entries made stale by the change
+func (r *CachedRepository) Invalidate(event events.Event) {
+	switch event.Kind {
+	case events.DevicesChanged, events.ChainMerged:
+		r.invalidateUser(event.UserDbID)
+	}
+}
+
+func (r *CachedRepository) invalidateUser(userDbID int64) {
+	if r.invalidatedInTx != nil {
+		*r.invalidatedInTx = append(*r.invalidatedInTx, userDbID)
+	}
+	r.usersByUserId.DeleteFunc(func(_ uuid.UUID, user db.User) bool {
+		return user.DbID == userDbID
+	})
+	r.usersBySyncCode.DeleteFunc(func(_ string, user db.User) bool {
+		return user.DbID == userDbID
+	})
+	r.devices.DeleteFunc(func(key deviceCacheKey, _ db.Device) bool {
+		return key.userDbID == userDbID
+	})
+}
+
+func (r *CachedRepository) invalidateDevice(deviceDbID int64) {
+	r.devices.DeleteFunc(func(_ deviceCacheKey, device db.Device) bool {
+		return device.DbID == deviceDbID
+	})
+}
+
+// The sync code may be an alias, and so differ from the user's own
+func (r *CachedRepository) cacheUser(syncCode string, user db.User) {
+	if r.bypass {
+		return
+	}
+	if userId, err := uuid.Parse(user.UserID); err == nil {
+		r.usersByUserId.Set(userId, user)
+	}
+	r.usersBySyncCode.Set(syncCode, user)
+}
+
+// The user id may be an alias, and so differ from the user's own
+func (r *CachedRepository) cacheUserId(userId uuid.UUID, user db.User) {
+	if r.bypass {
+		return
+	}
+	r.usersByUserId.Set(userId, user)
+}
+
+func (r *CachedRepository) cacheDevice(device db.Device) {
+	if r.bypass {
+		return
+	}
+	r.devices.Set(deviceCacheKey{device.UserDbID, device.LegacyDeviceID}, device)
+}
+
+func (r *CachedRepository) WithTx(ctx context.Context, fn func(repo Repository) error) error {
+	invalidated := r.invalidatedInTx
+	if invalidated == nil {
+		invalidated = &[]int64{}
+		// A concurrent lookup may have cached what the transaction changed before it was committed
+		defer func() {
+			for _, userDbID := range *invalidated {
+				r.invalidateUser(userDbID)
+			}
+		}()
+	}
+
+	return r.Repository.WithTx(ctx, func(repo Repository) error {
+		return fn(&CachedRepository{
+			Repository:      repo,
+			usersByUserId:   r.usersByUserId,
+			usersBySyncCode: r.usersBySyncCode,
+			devices:         r.devices,
+			bypass:          true,
+			invalidatedInTx: invalidated,
+		})
+	})
+}
+
+func (r *CachedRepository) GetUserByUserId(ctx context.Context, userId uuid.UUID) (db.User, error) {
+	if user, ok := r.usersByUserId.Get(userId); ok && !r.bypass {
+		return user, nil
+	}
+
+	user, err := r.Repository.GetUserByUserId(ctx, userId)
+	if err == nil {
+		r.cacheUser(user.LegacySyncCode, user)
+		r.cacheUserId(userId, user)
+	}
+	return user, err
+}
+
+func (r *CachedRepository) GetUserBySyncCode(ctx context.Context, syncCode string) (db.User, error) {
+	if user, ok := r.usersBySyncCode.Get(syncCode); ok && !r.bypass {
+		return user, nil
+	}
+
+	user, err := r.Repository.GetUserBySyncCode(ctx, syncCode)
+	if err == nil {
+		r.cacheUser(syncCode, user)
+	}
+	return user, err
+}
+
+func (r *CachedRepository) GetDeviceWithLegacyId(ctx context.Context, user db.User, legacyDeviceId int64) (db.Device, error) {
+	if device, ok := r.devices.Get(deviceCacheKey{user.DbID, legacyDeviceId}); ok && !r.bypass {
+		return device, nil
+	}
+
+	device, err := r.Repository.GetDeviceWithLegacyId(ctx, user, legacyDeviceId)
+	if err == nil {
+		r.cacheDevice(device)
+	}
+	return device, err
+}
+
+func (r *CachedRepository) AuthenticateDevice(ctx context.Context, credentials DeviceCredentials) (UserAndDevice, error) {
+	if !r.bypass {
+		var user db.User
+		var ok bool
+		if credentials.UserId != nil {
+			user, ok = r.usersByUserId.Get(*credentials.UserId)
+		} else {
+			user, ok = r.usersBySyncCode.Get(credentials.SyncCode)
+		}
+		if ok {
+			if device, ok := r.devices.Get(deviceCacheKey{user.DbID, credentials.LegacyDeviceId}); ok {
+				return UserAndDevice{User: user, Device: device}, nil
+			}
+		}
+	}
+
+	userDevice, err := r.Repository.AuthenticateDevice(ctx, credentials)
+	if err != nil {
+		return userDevice, err
+	}
+
+	syncCode := credentials.SyncCode
+	if credentials.UserId != nil {
+		syncCode = userDevice.User.LegacySyncCode
+		r.cacheUserId(*credentials.UserId, userDevice.User)
+	}
+	r.cacheUser(syncCode, userDevice.User)
+	r.cacheDevice(userDevice.Device)
+	return userDevice, nil
+}
+
+func (r *CachedRepository) RemoveDeviceWithLegacyId(ctx context.Context, user db.User, legacyDeviceId int64) (int, error) {
+	// Dropped before and after, so a concurrent lookup can't cache the device again in between
+	r.invalidateUser(user.DbID)
+	defer r.invalidateUser(user.DbID)
+	return r.Repository.RemoveDeviceWithLegacyId(ctx, user, legacyDeviceId)
+}
+
+func (r *CachedRepository) LeaveChain(ctx context.Context, user db.User, device db.Device) (bool, error) {
+	r.invalidateUser(user.DbID)
+	defer r.invalidateUser(user.DbID)
+	return r.Repository.LeaveChain(ctx, user, device)
+}
+
+func (r *CachedRepository) MergeChains(ctx context.Context, target db.User, source db.User) (MergeResult, error) {
+	r.invalidateUser(source.DbID)
+	defer r.invalidateUser(source.DbID)
+	return r.Repository.MergeChains(ctx, target, source)
+}
+
+func (r *CachedRepository) UpdateDevice(ctx context.Context, user db.User, deviceId uuid.UUID, update DeviceUpdate) (db.Device, error) {
+	defer r.invalidateUser(user.DbID)
+	return r.Repository.UpdateDevice(ctx, user, deviceId, update)
+}
+
+func (r *CachedRepository) ReapDevices(ctx context.Context, notSeenSince time.Time, batchSize int32) (ReapedDevices, error) {
+	reaped, err := r.Repository.ReapDevices(ctx, notSeenSince, batchSize)
+	if reaped.Devices > 0 {
+		// Which devices were reaped is not known here
+		r.devices.Clear()
+		r.usersByUserId.Clear()
+		r.usersBySyncCode.Clear()
+	}
+	return reaped, err
+}
+
+func (r *CachedRepository) SetPushEndpoint(ctx context.Context, device db.Device, endpoint string) error {
+	defer r.invalidateUser(device.UserDbID)
+	return r.Repository.SetPushEndpoint(ctx, device, endpoint)
+}
+
+func (r *CachedRepository) ClearPushEndpoint(ctx context.Context, deviceDbID int64, endpoint string) error {
+	defer r.invalidateDevice(deviceDbID)
+	return r.Repository.ClearPushEndpoint(ctx, deviceDbID, endpoint)
+}
@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spacecowboy/feeder-sync/build/gen/db"
+	"github.com/spacecowboy/feeder-sync/internal/events"
+)
+
+// Counts lookups. Only implements what the tests call.
+type countingRepository struct {
+	Repository
+	userDevice UserAndDevice
+	lookups    int
+}
+
+func (r *countingRepository) AuthenticateDevice(ctx context.Context, credentials DeviceCredentials) (UserAndDevice, error) {
+	r.lookups++
+	return r.userDevice, nil
+}
+
+func (r *countingRepository) GetUserBySyncCode(ctx context.Context, syncCode string) (db.User, error) {
+	r.lookups++
+	return r.userDevice.User, nil
+}
+
+func (r *countingRepository) RemoveDeviceWithLegacyId(ctx context.Context, user db.User, legacyDeviceId int64) (int, error) {
+	return 1, nil
+}
+
+func (r *countingRepository) WithTx(ctx context.Context, fn func(repo Repository) error) error {
+	return fn(r)
+}
+
+func newCountingRepository() *countingRepository {
+	return &countingRepository{
+		userDevice: UserAndDevice{
+			User:   db.User{DbID: 1, UserID: uuid.NewString(), LegacySyncCode: "code"},
+			Device: db.Device{DbID: 2, UserDbID: 1, LegacyDeviceID: 3},
+		},
+	}
+}
+
+func credentialsOf(userDevice UserAndDevice) DeviceCredentials {
+	return DeviceCredentials{
+		SyncCode:       userDevice.User.LegacySyncCode,
+		LegacyDeviceId: userDevice.Device.LegacyDeviceID,
+	}
+}
+
+func TestAuthenticateDeviceIsCached(t *testing.T) {
+	inner := newCountingRepository()
+	repo := NewCachedRepository(inner, 10, time.Minute)
+	ctx := context.Background()
+
+	for range 3 {
+		if _, err := repo.AuthenticateDevice(ctx, credentialsOf(inner.userDevice)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.GetUserBySyncCode(ctx, "code"); err != nil {
+		t.Fatal(err)
+	}
+
+	if inner.lookups != 1 {
+		t.Errorf("got %d lookups; want 1", inner.lookups)
+	}
+}
+
+func TestChangeNotificationInvalidates(t *testing.T) {
+	inner := newCountingRepository()
+	repo := NewCachedRepository(inner, 10, time.Minute)
+	ctx := context.Background()
+
+	_, _ = repo.AuthenticateDevice(ctx, credentialsOf(inner.userDevice))
+	// Other users' changes are irrelevant
+	repo.Invalidate(events.Event{UserDbID: 9, Kind: events.DevicesChanged})
+	// Read marks don't affect authentication
+	repo.Invalidate(events.Event{UserDbID: 1, Kind: events.ReadMarksChanged})
+	_, _ = repo.AuthenticateDevice(ctx, credentialsOf(inner.userDevice))
+	if inner.lookups != 1 {
+		t.Fatalf("got %d lookups; want 1", inner.lookups)
+	}
+
+	repo.Invalidate(events.Event{UserDbID: 1, Kind: events.DevicesChanged})
+	_, _ = repo.AuthenticateDevice(ctx, credentialsOf(inner.userDevice))
+	if inner.lookups != 2 {
+		t.Errorf("got %d lookups; want 2", inner.lookups)
+	}
+}
+
+func TestRemovingDeviceInvalidates(t *testing.T) {
+	inner := newCountingRepository()
+	repo := NewCachedRepository(inner, 10, time.Minute)
+	ctx := context.Background()
+
+	_, _ = repo.AuthenticateDevice(ctx, credentialsOf(inner.userDevice))
+	err := repo.WithTx(ctx, func(tx Repository) error {
+		_, err := tx.RemoveDeviceWithLegacyId(ctx, inner.userDevice.User, inner.userDevice.Device.LegacyDeviceID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = repo.AuthenticateDevice(ctx, credentialsOf(inner.userDevice))
+	if inner.lookups != 2 {
+		t.Errorf("got %d lookups; want 2", inner.lookups)
+	}
+}
+
+func TestTransactionsBypassCache(t *testing.T) {
+	inner := newCountingRepository()
+	repo := NewCachedRepository(inner, 10, time.Minute)
+	ctx := context.Background()
+
+	_, _ = repo.AuthenticateDevice(ctx, credentialsOf(inner.userDevice))
+	_ = repo.WithTx(ctx, func(tx Repository) error {
+		_, err := tx.AuthenticateDevice(ctx, credentialsOf(inner.userDevice))
+		return err
+	})
+
+	if inner.lookups != 2 {
+		t.Errorf("got %d lookups; want 2", inner.lookups)
+	}
+}
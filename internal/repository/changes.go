@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/spacecowboy/feeder-sync/internal/events"
+)
+
+// Postgres channel which NotifyChange sends on
+const ChangesChannel = "feeder_sync_changes"
+
+const (
+	listenRetryMin = 1 * time.Second
+	listenRetryMax = 1 * time.Minute
+)
+
+// Payload of a notification on ChangesChannel
+type changeNotification struct {
+	UserDbID   int64  `json:"user"`
+	Kind       string `json:"kind"`
+	DeviceDbID int64  `json:"device"`
+	Sequence   int64  `json:"seq"`
+}
+
+// ListenForChanges dispatches changes made by any instance to the handler.
+// A single connection is held for the purpose, and re-established if lost.
+// Blocks until the context is cancelled. Returns at once inside WithTx, as listening needs its own connection.
+func (r *PostgresRepository) ListenForChanges(ctx context.Context, handler func(events.Event)) {
+	if r.tx != nil {
+		slog.ErrorContext(ctx, "Not listening for changes", "error", errBoundToTx)
+		return
+	}
+
+	retryDelay := listenRetryMin
+
+	for {
+		err := r.listen(ctx, handler, func() { retryDelay = listenRetryMin })
+		if ctx.Err() != nil {
+			return
+		}
+
+		slog.WarnContext(ctx, "Listening for changes failed, retrying", "retry_in", retryDelay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+		retryDelay = min(retryDelay*2, listenRetryMax)
+	}
+}
+
+func (r *PostgresRepository) listen(ctx context.Context, handler func(events.Event), onListening func()) error {
+	pooled, err := r.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection is in LISTEN mode so must not be reused by others.
+	// Taken out of the pool, which then no longer counts or closes it.
+	conn := pooled.Hijack()
+	defer func() {
+		_ = conn.Close(context.Background())
+	}()
+
+	// LISTEN doesn't take parameters
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{ChangesChannel}.Sanitize()); err != nil {
+		return err
+	}
+	onListening()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var change changeNotification
+		if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+			slog.WarnContext(ctx, "Ignoring malformed change notification", "payload", notification.Payload, "error", err)
+			continue
+		}
+
+		handler(events.Event{
+			UserDbID:         change.UserDbID,
+			Kind:             events.Kind(change.Kind),
+			SourceDeviceDbID: change.DeviceDbID,
+			Sequence:         change.Sequence,
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package repository
+
+import "errors"
+
+// Kinds of domain errors. Every error returned by the repository either matches
+// one of these with errors.Is, or is unexpected.
+var (
+	ErrNotFound = errors.New("repository: not found")
+	ErrConflict = errors.New("repository: conflict")
+	ErrInvalid  = errors.New("repository: invalid")
+)
+
+// Error is a domain error of a specific kind
+type Error struct {
+	kind    error
+	message string
+}
+
+func (e *Error) Error() string {
+	return "repository: " + e.message
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+var (
+	ErrNoSuchUser   = &Error{kind: ErrNotFound, message: "no such user"}
+	ErrNoSuchDevice = &Error{kind: ErrNotFound, message: "no such device"}
+	ErrNoReadMarks  = &Error{kind: ErrNotFound, message: "no read marks"}
+	ErrNoFeeds      = &Error{kind: ErrNotFound, message: "no feeds"}
+	// The database has not been migrated
+	ErrNoSchemaVersion = &Error{kind: ErrNotFound, message: "no schema version"}
+	ErrSameChain       = &Error{kind: ErrInvalid, message: "cannot merge a chain into itself"}
+	// A device of one chain has the same legacy id as a device of the other chain
+	ErrLegacyDeviceIdTaken = &Error{kind: ErrConflict, message: "legacy device id is taken"}
+)
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Number of times an insert is attempted with fresh random ids
+const maxInsertAttempts = 5
+
+// Unique indices on randomly generated ids. A violation of one of these
+// means the id was taken, and the insert can be retried with a new one.
+var randomIdConstraints = map[string]bool{
+	"idx_users_user_id":                       true,
+	"idx_users_legacy_sync_code":              true,
+	"idx_devices_device_id":                   true,
+	"idx_devices_user_db_id_legacy_device_id": true,
+}
+
+// Runs insert until it succeeds, or fails for any other reason than a taken random id.
+// Insert must generate new ids every time, and must run in its own transaction
+// since the failed statement aborts it.
+func retryOnIdCollision(insert func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := insert()
+
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != pgerrcode.UniqueViolation || !randomIdConstraints[pgErr.ConstraintName] {
+			return err
+		}
+
+		if attempt >= maxInsertAttempts {
+			return fmt.Errorf("random id still taken after %d attempts: %w", attempt, err)
+		}
+		slog.Warn("Random id collided, retrying", "constraint", pgErr.ConstraintName)
+	}
+}
+
+// Positive, and unpredictable
+func randomLegacyDeviceId() (int64, error) {
+	var bytes [8]byte
+	if _, err := rand.Read(bytes[:]); err != nil {
+		return 0, err
+	}
+	id := int64(binary.BigEndian.Uint64(bytes[:]) >> 1)
+	if id == 0 {
+		// Zero is not a valid id for clients
+		return randomLegacyDeviceId()
+	}
+	return id, nil
+}
+
+func randomLegacySyncCode() (string, error) {
+	bytes := make([]byte, 30)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	syncCode := fmt.Sprintf("feed%s", hex.EncodeToString(bytes))
+
+	if got := len(syncCode); got != 64 {
+		return "", fmt.Errorf("Code was %d long not 64", got)
+	}
+	return syncCode, nil
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation
+}
+
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == constraint
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestRetryOnIdCollisionRetriesTakenIds(t *testing.T) {
+	attempts := 0
+	err := retryOnIdCollision(func() error {
+		attempts++
+		if attempts < 3 {
+			return &pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: "idx_devices_user_db_id_legacy_device_id"}
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("err = %v; want nil", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d; want 3", attempts)
+	}
+}
+
+func TestRetryOnIdCollisionGivesUp(t *testing.T) {
+	attempts := 0
+	collision := &pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: "idx_users_legacy_sync_code"}
+	err := retryOnIdCollision(func() error {
+		attempts++
+		return collision
+	})
+
+	if !errors.Is(err, collision) {
+		t.Errorf("err = %v; want %v", err, collision)
+	}
+	if attempts != maxInsertAttempts {
+		t.Errorf("attempts = %d; want %d", attempts, maxInsertAttempts)
+	}
+}
+
+func TestRetryOnIdCollisionIgnoresOtherErrors(t *testing.T) {
+	tests := []error{
+		errors.New("connection refused"),
+		&pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: "some_other_index"},
+		&pgconn.PgError{Code: pgerrcode.ForeignKeyViolation, ConstraintName: "idx_devices_device_id"},
+	}
+
+	for _, want := range tests {
+		attempts := 0
+		err := retryOnIdCollision(func() error {
+			attempts++
+			return want
+		})
+
+		if err != want || attempts != 1 {
+			t.Errorf("got %v after %d attempts; want %v after 1", err, attempts, want)
+		}
+	}
+}
+
+func TestRandomLegacyDeviceIdIsPositive(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		id, err := randomLegacyDeviceId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= 0 {
+			t.Fatalf("id = %d; want positive", id)
+		}
+	}
+}
@@ -2,24 +2,26 @@ package repository
 
 import (
 	"context"
-	crand "crypto/rand"
 	"encoding/base64"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"log/slog"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/spacecowboy/feeder-sync/build/gen/db"
+	"github.com/spacecowboy/feeder-sync/internal/events"
 )
 
 type PostgresRepository struct {
 	pool *pgxpool.Pool
+	// Set when the repository is bound to a transaction by WithTx
+	tx pgx.Tx
 }
 
 func NewPostgresRepository(pool *pgxpool.Pool) *PostgresRepository {
@@ -31,61 +33,165 @@ func NewPostgresRepository(pool *pgxpool.Pool) *PostgresRepository {
 // Verify interface implementation
 var _ Repository = &PostgresRepository{}
 
+// Returned by what acts on the pool, or a session, rather than the transaction of WithTx
+var errBoundToTx = errors.New("repository: not allowed inside a transaction")
+
 // Acquire a connection from the pool and return a Queries object
 // Caller must call the release function to release the connection back to the pool
 func (r *PostgresRepository) queries(ctx context.Context) (*db.Queries, func(), error) {
+	if r.tx != nil {
+		return db.New(r.tx), func() {}, nil
+	}
+
 	conn, err := r.pool.Acquire(ctx)
 	if err != nil {
-		log.Printf("failed to acquire connection: %v", err)
+		slog.ErrorContext(ctx, "Failed to acquire connection", "error", err)
 		return nil, nil, err
 	}
 	return db.New(conn), conn.Release, nil
 }
 
+// Starts transactions on the pool, or savepoints inside the transaction of WithTx
+func (r *PostgresRepository) beginner() interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+} {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.pool
+}
+
+// Runs fn inside a transaction which is committed if fn returns nil
+func (r *PostgresRepository) inTx(ctx context.Context, fn func(queries *db.Queries) error) error {
+	return pgx.BeginFunc(ctx, r.beginner(), func(tx pgx.Tx) error {
+		return fn(db.New(tx))
+	})
+}
+
+func (r *PostgresRepository) WithTx(ctx context.Context, fn func(repo Repository) error) error {
+	return pgx.BeginFunc(ctx, r.beginner(), func(tx pgx.Tx) error {
+		return fn(&PostgresRepository{pool: r.pool, tx: tx})
+	})
+}
+
+// Notifies all instances about a change once the surrounding transaction commits
+func notifyChange(ctx context.Context, queries *db.Queries, userDbID int64, kind events.Kind, deviceDbID int64) error {
+	return queries.NotifyChange(ctx, db.NotifyChangeParams{
+		UserDbID:   userDbID,
+		Kind:       string(kind),
+		DeviceDbID: deviceDbID,
+	})
+}
+
 func (r *PostgresRepository) Close(ctx context.Context) error {
+	if r.tx != nil {
+		return errBoundToTx
+	}
 	r.pool.Close()
 	return nil
 }
 
 func (r *PostgresRepository) RegisterNewUser(ctx context.Context, deviceName string) (UserAndDevice, error) {
-	legacySyncCode, err := randomLegacySyncCode()
+	var user db.User
+	var device db.Device
+	err := retryOnIdCollision(func() error {
+		legacySyncCode, err := randomLegacySyncCode()
+		if err != nil {
+			return err
+		}
+
+		return r.inTx(ctx, func(queries *db.Queries) error {
+			var err error
+			user, err = queries.InsertUser(ctx, db.InsertUserParams{
+				UserID:         uuid.NewString(),
+				LegacySyncCode: legacySyncCode,
+			})
+			if err != nil {
+				return err
+			}
+
+			device, err = insertDevice(ctx, queries, user, deviceName)
+			return err
+		})
+	})
 	if err != nil {
 		return UserAndDevice{}, err
 	}
 
-	queries, release, err := r.queries(ctx)
-	if err != nil {
-		return UserAndDevice{}, err
-	}
-	defer release()
+	return UserAndDevice{
+		User:   user,
+		Device: device,
+	}, nil
+}
 
-	insertUserParams := db.InsertUserParams{
-		UserID:         uuid.NewString(),
-		LegacySyncCode: legacySyncCode,
-	}
-	user, err := queries.InsertUser(ctx, insertUserParams)
+// Inserts a device with new random ids
+func insertDevice(ctx context.Context, queries *db.Queries, user db.User, deviceName string) (db.Device, error) {
+	legacyDeviceId, err := randomLegacyDeviceId()
 	if err != nil {
-		return UserAndDevice{}, err
+		return db.Device{}, err
 	}
 
-	device, err := queries.InsertDevice(ctx, db.InsertDeviceParams{
+	return queries.InsertDevice(ctx, db.InsertDeviceParams{
 		UserDbID:       user.DbID,
 		DeviceID:       uuid.NewString(),
 		DeviceName:     deviceName,
-		LegacyDeviceID: rand.Int63(),
+		LegacyDeviceID: legacyDeviceId,
 		LastSeen: pgtype.Timestamptz{
 			Time:  time.Now(),
 			Valid: true,
 		},
 	})
+}
+
+func (r *PostgresRepository) AuthenticateDevice(ctx context.Context, credentials DeviceCredentials) (UserAndDevice, error) {
+	queries, release, err := r.queries(ctx)
 	if err != nil {
 		return UserAndDevice{}, err
 	}
+	defer release()
 
-	return UserAndDevice{
-		User:   user,
-		Device: device,
-	}, nil
+	params := db.AuthenticateDeviceParams{
+		LegacyDeviceID: credentials.LegacyDeviceId,
+	}
+	if credentials.UserId != nil {
+		params.UserID = pgtype.Text{String: credentials.UserId.String(), Valid: true}
+	} else {
+		params.SyncCode = pgtype.Text{String: credentials.SyncCode, Valid: true}
+	}
+
+	row, err := queries.AuthenticateDevice(ctx, params)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return UserAndDevice{}, ErrNoSuchUser
+	}
+	if err != nil {
+		return UserAndDevice{}, err
+	}
+
+	result := UserAndDevice{
+		User: db.User{
+			DbID:                  row.DbID,
+			UserID:                row.UserID,
+			LegacySyncCode:        row.LegacySyncCode,
+			ReadmarksPrunedBefore: row.ReadmarksPrunedBefore,
+		},
+	}
+	if !row.DeviceDbID.Valid {
+		return result, ErrNoSuchDevice
+	}
+
+	result.Device = db.Device{
+		DbID:           row.DeviceDbID.Int64,
+		DeviceID:       row.DeviceID.String,
+		LegacyDeviceID: row.LegacyDeviceID.Int64,
+		DeviceName:     row.DeviceName.String,
+		LastSeen:       row.LastSeen,
+		UserDbID:       row.DbID,
+		PushEndpoint:   row.PushEndpoint,
+		Platform:       row.Platform.String,
+		AppVersion:     row.AppVersion.String,
+		RegisteredAt:   row.RegisteredAt,
+	}
+	return result, nil
 }
 
 func (r *PostgresRepository) GetUserByUserId(ctx context.Context, userId uuid.UUID) (db.User, error) {
@@ -95,7 +201,11 @@ func (r *PostgresRepository) GetUserByUserId(ctx context.Context, userId uuid.UU
 	}
 	defer release()
 
-	return queries.GetUserByUserId(ctx, userId.String())
+	user, err := queries.GetUserByUserId(ctx, userId.String())
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, ErrNoSuchUser
+	}
+	return user, err
 }
 
 func (r *PostgresRepository) GetUserBySyncCode(ctx context.Context, syncCode string) (db.User, error) {
@@ -105,26 +215,31 @@ func (r *PostgresRepository) GetUserBySyncCode(ctx context.Context, syncCode str
 	}
 	defer release()
 
-	return queries.GetUserBySyncCode(ctx, syncCode)
+	user, err := queries.GetUserBySyncCode(ctx, syncCode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, ErrNoSuchUser
+	}
+	return user, err
 }
 
 func (r *PostgresRepository) AddDeviceToUser(ctx context.Context, user db.User, deviceName string) (db.Device, error) {
-	queries, release, err := r.queries(ctx)
-	if err != nil {
-		return db.Device{}, err
-	}
-	defer release()
-
-	return queries.InsertDevice(ctx, db.InsertDeviceParams{
-		UserDbID:       user.DbID,
-		DeviceID:       uuid.NewString(),
-		DeviceName:     deviceName,
-		LegacyDeviceID: rand.Int63(),
-		LastSeen: pgtype.Timestamptz{
-			Time:  time.Now(),
-			Valid: true,
-		},
+	var device db.Device
+	err := retryOnIdCollision(func() error {
+		return r.inTx(ctx, func(queries *db.Queries) error {
+			var err error
+			device, err = insertDevice(ctx, queries, user, deviceName)
+			if isForeignKeyViolation(err) {
+				// The chain was deleted in the meantime
+				return ErrNoSuchUser
+			}
+			if err != nil {
+				return err
+			}
+
+			return notifyChange(ctx, queries, user.DbID, events.DevicesChanged, device.DbID)
+		})
 	})
+	return device, err
 }
 
 func (r *PostgresRepository) GetDevices(ctx context.Context, user db.User) ([]db.Device, error) {
@@ -144,62 +259,226 @@ func (r *PostgresRepository) GetDeviceWithLegacyId(ctx context.Context, user db.
 	}
 	defer release()
 
-	return queries.GetLegacyDevice(ctx, db.GetLegacyDeviceParams{
+	device, err := queries.GetLegacyDevice(ctx, db.GetLegacyDeviceParams{
 		UserDbID:       user.DbID,
 		LegacyDeviceID: deviceId,
 	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return device, ErrNoSuchDevice
+	}
+	return device, err
 }
 
-func (r *PostgresRepository) GetDevicesEtag(ctx context.Context, user db.User) (string, error) {
+func (r *PostgresRepository) GetDevicesEtag(ctx context.Context, user db.User, staleBefore time.Time) (string, error) {
 	queries, release, err := r.queries(ctx)
 	if err != nil {
 		return "", err
 	}
 	defer release()
 
-	etagBytes, err := queries.GetLegacyDevicesEtag(ctx, user.DbID)
+	etagBytes, err := queries.GetDevicesEtag(ctx, db.GetDevicesEtagParams{
+		StaleBefore: pgtype.Timestamptz{
+			Time:  staleBefore,
+			Valid: true,
+		},
+		UserDbID: user.DbID,
+	})
 	if err != nil {
 		return "", err
 	}
-	return base64.StdEncoding.EncodeToString(etagBytes), nil
+	return fmt.Sprintf("%q", base64.StdEncoding.EncodeToString(etagBytes)), nil
 }
 
 func (r *PostgresRepository) RemoveDeviceWithLegacyId(ctx context.Context, user db.User, legacyDeviceId int64) (int, error) {
-	queries, release, err := r.queries(ctx)
+	var ids []int64
+	err := r.inTx(ctx, func(queries *db.Queries) error {
+		var err error
+		ids, err = queries.DeleteDeviceWithLegacyId(ctx, db.DeleteDeviceWithLegacyIdParams{
+			UserDbID:       user.DbID,
+			LegacyDeviceID: legacyDeviceId,
+		})
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return ErrNoSuchDevice
+		}
+
+		return notifyChange(ctx, queries, user.DbID, events.DevicesChanged, events.SourceDevice(ctx))
+	})
 	if err != nil {
 		return 0, err
 	}
-	defer release()
+	return len(ids), nil
+}
 
-	ids, err := queries.DeleteDeviceWithLegacyId(ctx, db.DeleteDeviceWithLegacyIdParams{
-		UserDbID:       user.DbID,
-		LegacyDeviceID: legacyDeviceId,
+func (r *PostgresRepository) LeaveChain(ctx context.Context, user db.User, device db.Device) (bool, error) {
+	var chainDeleted bool
+	err := r.inTx(ctx, func(queries *db.Queries) error {
+		ids, err := queries.DeleteDeviceWithLegacyId(ctx, db.DeleteDeviceWithLegacyIdParams{
+			UserDbID:       user.DbID,
+			LegacyDeviceID: device.LegacyDeviceID,
+		})
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return ErrNoSuchDevice
+		}
+
+		deletedUsers, err := queries.DeleteUsersWithoutDevices(ctx, []int64{user.DbID})
+		if err != nil {
+			return err
+		}
+		chainDeleted = deletedUsers > 0
+		if chainDeleted {
+			// Nobody left to notify
+			return nil
+		}
+
+		return notifyChange(ctx, queries, user.DbID, events.DevicesChanged, device.DbID)
+	})
+	return chainDeleted, err
+}
+
+func (r *PostgresRepository) UpdateDevice(ctx context.Context, user db.User, deviceId uuid.UUID, update DeviceUpdate) (db.Device, error) {
+	var device db.Device
+	err := r.inTx(ctx, func(queries *db.Queries) error {
+		var err error
+		device, err = queries.UpdateDevice(ctx, db.UpdateDeviceParams{
+			DeviceName: optionalText(update.DeviceName),
+			Platform:   optionalText(update.Platform),
+			AppVersion: optionalText(update.AppVersion),
+			UserDbID:   user.DbID,
+			DeviceID:   deviceId.String(),
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNoSuchDevice
+		} else if err != nil {
+			return err
+		}
+
+		return notifyChange(ctx, queries, user.DbID, events.DevicesChanged, events.SourceDevice(ctx))
+	})
+	return device, err
+}
+
+func (r *PostgresRepository) ReapDevices(ctx context.Context, notSeenSince time.Time, batchSize int32) (ReapedDevices, error) {
+	var reaped ReapedDevices
+	err := r.inTx(ctx, func(queries *db.Queries) error {
+		userDbIds, err := queries.DeleteDevicesNotSeenSince(ctx, db.DeleteDevicesNotSeenSinceParams{
+			LastSeen: pgtype.Timestamptz{
+				Time:  notSeenSince,
+				Valid: true,
+			},
+			Limit: batchSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Users without devices are deleted even if their devices went earlier,
+		// so that a failed or interrupted run is made up for by the next one
+		orphans, err := queries.GetUsersWithoutDevices(ctx, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(userDbIds) == 0 && len(orphans) == 0 {
+			return nil
+		}
+
+		users, err := queries.DeleteUsersWithoutDevices(ctx, append(orphans, userDbIds...))
+		if err != nil {
+			return err
+		}
+		reaped = ReapedDevices{
+			Devices: int64(len(userDbIds)),
+			Users:   users,
+		}
+
+		// Lets every instance forget the reaped devices
+		notified := make(map[int64]bool, len(userDbIds))
+		for _, userDbID := range userDbIds {
+			if notified[userDbID] {
+				continue
+			}
+			notified[userDbID] = true
+			if err := notifyChange(ctx, queries, userDbID, events.DevicesChanged, 0); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	if err != nil {
-		return 0, err
+		return ReapedDevices{}, err
 	}
-	if len(ids) == 0 {
-		return 0, ErrNoSuchDevice
+	return reaped, nil
+}
+
+func (r *PostgresRepository) UpdateLastSeen(ctx context.Context, lastSeen map[int64]time.Time) error {
+	params := db.UpdateLastSeenForDevicesParams{
+		DbIds:    make([]int64, 0, len(lastSeen)),
+		LastSeen: make([]pgtype.Timestamptz, 0, len(lastSeen)),
+	}
+	for deviceDbID, seen := range lastSeen {
+		params.DbIds = append(params.DbIds, deviceDbID)
+		params.LastSeen = append(params.LastSeen, pgtype.Timestamptz{Time: seen, Valid: true})
+	}
+
+	queries, release, err := r.queries(ctx)
+	if err != nil {
+		return err
 	}
-	return len(ids), err
+	defer release()
+
+	return queries.UpdateLastSeenForDevices(ctx, params)
 }
 
-func (r *PostgresRepository) UpdateLastSeenForDevice(ctx context.Context, device db.Device) error {
+func (r *PostgresRepository) SetPushEndpoint(ctx context.Context, device db.Device, endpoint string) error {
 	queries, release, err := r.queries(ctx)
 	if err != nil {
 		return err
 	}
 	defer release()
 
-	return queries.UpdateLastSeenForDevice(ctx, db.UpdateLastSeenForDeviceParams{
-		LastSeen: pgtype.Timestamptz{
-			Time:  time.Now(),
-			Valid: true,
+	return queries.UpdatePushEndpoint(ctx, db.UpdatePushEndpointParams{
+		PushEndpoint: pgtype.Text{
+			String: endpoint,
+			Valid:  endpoint != "",
 		},
 		DbID: device.DbID,
 	})
 }
 
+func (r *PostgresRepository) GetPushEndpoints(ctx context.Context, userDbID int64, exceptDeviceDbID int64) ([]db.GetPushEndpointsRow, error) {
+	queries, release, err := r.queries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return queries.GetPushEndpoints(ctx, db.GetPushEndpointsParams{
+		UserDbID: userDbID,
+		DbID:     exceptDeviceDbID,
+	})
+}
+
+func (r *PostgresRepository) ClearPushEndpoint(ctx context.Context, deviceDbID int64, endpoint string) error {
+	queries, release, err := r.queries(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return queries.ClearPushEndpoint(ctx, db.ClearPushEndpointParams{
+		DbID: deviceDbID,
+		PushEndpoint: pgtype.Text{
+			String: endpoint,
+			Valid:  true,
+		},
+	})
+}
+
 func (r *PostgresRepository) GetArticlesUpdatedSince(ctx context.Context, user db.User, sinceMillis int64) ([]db.Article, error) {
 	queries, release, err := r.queries(ctx)
 	if err != nil {
@@ -220,22 +499,43 @@ func (r *PostgresRepository) GetArticlesUpdatedSince(ctx context.Context, user d
 	return articles, err
 }
 
-func (r *PostgresRepository) AddArticle(ctx context.Context, user db.User, identifier string) (db.Article, error) {
+func (r *PostgresRepository) AddArticles(ctx context.Context, user db.User, identifiers []string) (int64, error) {
+	var inserted int64
+	err := r.inTx(ctx, func(queries *db.Queries) error {
+		var err error
+		inserted, err = queries.InsertArticles(ctx, db.InsertArticlesParams{
+			UserDbID:    user.DbID,
+			Identifiers: identifiers,
+			ReadTime: pgtype.Timestamptz{
+				Time:  time.Now(),
+				Valid: true,
+			},
+		})
+		if err != nil || inserted == 0 {
+			return err
+		}
+
+		return notifyChange(ctx, queries, user.DbID, events.ReadMarksChanged, events.SourceDevice(ctx))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+func (r *PostgresRepository) PruneReadMarks(ctx context.Context, readBefore time.Time, batchSize int32) (int64, error) {
 	queries, release, err := r.queries(ctx)
 	if err != nil {
-		return db.Article{}, err
+		return 0, err
 	}
 	defer release()
 
-	timestamp := pgtype.Timestamptz{
-		Time:  time.Now(),
-		Valid: true,
-	}
-	return queries.InsertArticle(ctx, db.InsertArticleParams{
-		UserDbID:   user.DbID,
-		Identifier: identifier,
-		UpdatedAt:  timestamp,
-		ReadTime:   timestamp,
+	return queries.PruneArticlesReadBefore(ctx, db.PruneArticlesReadBeforeParams{
+		ReadTime: pgtype.Timestamptz{
+			Time:  readBefore,
+			Valid: true,
+		},
+		Limit: batchSize,
 	})
 }
 
@@ -254,18 +554,170 @@ func (r *PostgresRepository) GetLegacyFeeds(ctx context.Context, user db.User) (
 }
 
 func (r *PostgresRepository) UpdateLegacyFeeds(ctx context.Context, user db.User, contentHash int64, content string, etag string) (int64, error) {
+	var dbId int64
+	err := r.inTx(ctx, func(queries *db.Queries) error {
+		var err error
+		dbId, err = queries.UpdateLegacyFeeds(ctx, db.UpdateLegacyFeedsParams{
+			UserDbID:    user.DbID,
+			ContentHash: contentHash,
+			Content:     content,
+			Etag:        etag,
+		})
+		if err != nil {
+			return err
+		}
+
+		return notifyChange(ctx, queries, user.DbID, events.FeedsChanged, events.SourceDevice(ctx))
+	})
+	return dbId, err
+}
+
+func (r *PostgresRepository) GetLegacyFeedsVersions(ctx context.Context, user db.User) ([]db.LegacyFeedsVersion, error) {
+	queries, release, err := r.queries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return queries.GetLegacyFeedsVersions(ctx, user.DbID)
+}
+
+func (r *PostgresRepository) PruneLegacyFeedsVersions(ctx context.Context, user db.User, maxVersions int, maxBytes int64) (int64, error) {
 	queries, release, err := r.queries(ctx)
 	if err != nil {
 		return 0, err
 	}
 	defer release()
 
-	return queries.UpdateLegacyFeeds(ctx, db.UpdateLegacyFeedsParams{
+	return queries.PruneLegacyFeedsVersions(ctx, db.PruneLegacyFeedsVersionsParams{
 		UserDbID:    user.DbID,
-		ContentHash: contentHash,
-		Content:     content,
-		Etag:        etag,
+		MaxVersions: int32(maxVersions),
+		MaxBytes:    maxBytes,
+	})
+}
+
+func (r *PostgresRepository) MergeChains(ctx context.Context, target db.User, source db.User) (MergeResult, error) {
+	var result MergeResult
+	if target.DbID == source.DbID {
+		return result, ErrSameChain
+	}
+
+	err := r.inTx(ctx, func(queries *db.Queries) error {
+		// Concurrent merges can't deadlock, or merge a chain which is being deleted
+		err := lockUsers(ctx, queries, target, source)
+		if err != nil {
+			return err
+		}
+
+		users := db.ArchiveLegacyFeedsParams{TargetUserDbID: target.DbID, SourceUserDbID: source.DbID}
+
+		result.FeedsVersions, err = queries.ArchiveLegacyFeeds(ctx, users)
+		if err != nil {
+			return err
+		}
+		if err := queries.MoveLegacyFeedsVersions(ctx, db.MoveLegacyFeedsVersionsParams(users)); err != nil {
+			return err
+		}
+		adoptedFeeds, err := queries.AdoptLegacyFeeds(ctx, db.AdoptLegacyFeedsParams(users))
+		if err != nil {
+			return err
+		}
+
+		result.ReadMarks, err = queries.MoveArticles(ctx, db.MoveArticlesParams{
+			SourceUserDbID: source.DbID,
+			TargetUserDbID: target.DbID,
+			// So the target's devices fetch them
+			UpdatedAt: pgtype.Timestamptz{Time: time.Now(), Valid: true},
+		})
+		if err != nil {
+			return err
+		}
+
+		// Legacy device ids are random, so a collision here is improbable. If it happens, the merge fails.
+		result.Devices, err = queries.MoveDevices(ctx, db.MoveDevicesParams(users))
+		if isUniqueViolation(err, "idx_devices_user_db_id_legacy_device_id") {
+			return ErrLegacyDeviceIdTaken
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := queries.MergeSyncCodeAliases(ctx, db.MergeSyncCodeAliasesParams(users)); err != nil {
+			return err
+		}
+		if err := queries.MergeUserIdAliases(ctx, db.MergeUserIdAliasesParams(users)); err != nil {
+			return err
+		}
+
+		deleted, err := queries.DeleteUsersWithoutDevices(ctx, []int64{source.DbID})
+		if err != nil {
+			return err
+		}
+		if deleted != 1 {
+			return fmt.Errorf("source user %d was not deleted after merge", source.DbID)
+		}
+
+		sourceDevice := events.SourceDevice(ctx)
+		if err := notifyChange(ctx, queries, source.DbID, events.ChainMerged, 0); err != nil {
+			return err
+		}
+		if err := notifyChange(ctx, queries, target.DbID, events.DevicesChanged, sourceDevice); err != nil {
+			return err
+		}
+		if err := notifyChange(ctx, queries, target.DbID, events.ReadMarksChanged, sourceDevice); err != nil {
+			return err
+		}
+		if adoptedFeeds > 0 {
+			return notifyChange(ctx, queries, target.DbID, events.FeedsChanged, sourceDevice)
+		}
+		return nil
 	})
+	return result, err
+}
+
+// Locks the users in a fixed order, so that callers locking the same users can't deadlock
+func lockUsers(ctx context.Context, queries *db.Queries, users ...db.User) error {
+	userDbIds := make([]int64, 0, len(users))
+	for _, user := range users {
+		userDbIds = append(userDbIds, user.DbID)
+	}
+
+	locked, err := queries.LockUsers(ctx, userDbIds)
+	if err != nil {
+		return err
+	}
+	if len(locked) != len(users) {
+		return ErrNoSuchUser
+	}
+	return nil
+}
+
+func (r *PostgresRepository) LockUsers(ctx context.Context, users ...db.User) error {
+	queries, release, err := r.queries(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return lockUsers(ctx, queries, users...)
+}
+
+func (r *PostgresRepository) GetUsage(ctx context.Context, user db.User) (Usage, error) {
+	queries, release, err := r.queries(ctx)
+	if err != nil {
+		return Usage{}, err
+	}
+	defer release()
+
+	usage, err := queries.GetUserUsage(ctx, user.DbID)
+	if err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		ReadMarks:  usage.ReadMarks,
+		Devices:    usage.Devices,
+		FeedsBytes: usage.FeedsBytes,
+	}, nil
 }
 
 // func (r *PostgresRepository) EnsureMigration(ctx context.Context, syncCode string, deviceId int64, deviceName string) (int64, error) {
@@ -314,6 +766,10 @@ func (r *PostgresRepository) AcceptLegacyFeeds(ctx context.Context, feeds *db.Le
 }
 
 func (r *PostgresRepository) PingContext(ctx context.Context) error {
+	if r.tx != nil {
+		return errBoundToTx
+	}
+
 	conn, err := r.pool.Acquire(ctx)
 	if err != nil {
 		return err
@@ -323,16 +779,47 @@ func (r *PostgresRepository) PingContext(ctx context.Context) error {
 	return conn.Ping(ctx)
 }
 
-func randomLegacySyncCode() (string, error) {
-	bytes := make([]byte, 30)
-	if _, err := crand.Read(bytes); err != nil {
-		return "", err
+// Table golang-migrate records the schema version in
+const schemaMigrationsTable = "schema_migrations"
+
+func (r *PostgresRepository) GetSchemaVersion(ctx context.Context) (SchemaVersion, error) {
+	if r.tx != nil {
+		return SchemaVersion{}, errBoundToTx
 	}
-	syncCode := fmt.Sprintf("feed%s", hex.EncodeToString(bytes))
 
-	if got := len(syncCode); got != 64 {
-		log.Printf("code was %d long", got)
-		return "", fmt.Errorf("Code was %d long not 64", got)
+	var version SchemaVersion
+	// Not a sqlc query since the table is not part of the schema
+	err := r.pool.QueryRow(
+		ctx,
+		"SELECT version, dirty FROM "+pgx.Identifier{schemaMigrationsTable}.Sanitize()+" LIMIT 1",
+	).Scan(&version.Version, &version.Dirty)
+
+	var pgErr *pgconn.PgError
+	if errors.Is(err, pgx.ErrNoRows) || (errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UndefinedTable) {
+		return SchemaVersion{}, ErrNoSchemaVersion
+	}
+	return version, err
+}
+
+func (r *PostgresRepository) PoolStats() PoolStats {
+	stat := r.pool.Stat()
+	return PoolStats{
+		AcquiredConns:     stat.AcquiredConns(),
+		IdleConns:         stat.IdleConns(),
+		TotalConns:        stat.TotalConns(),
+		MaxConns:          stat.MaxConns(),
+		EmptyAcquireCount: stat.EmptyAcquireCount(),
+		AcquireDuration:   stat.AcquireDuration(),
+	}
+}
+
+// Nil becomes NULL
+func optionalText(value *string) pgtype.Text {
+	if value == nil {
+		return pgtype.Text{}
+	}
+	return pgtype.Text{
+		String: *value,
+		Valid:  true,
 	}
-	return syncCode, nil
 }
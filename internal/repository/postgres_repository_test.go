@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/spacecowboy/feeder-sync/internal/events"
+)
+
+// Stands in for the transaction of WithTx. Calling any of its methods panics.
+type unusedTx struct {
+	pgx.Tx
+}
+
+// The pool is nil, so anything reaching it panics instead of failing
+func TestRepositoryBoundToTxRejectsSessionOperations(t *testing.T) {
+	ctx := context.Background()
+	repo := &PostgresRepository{tx: unusedTx{}}
+
+	if err := repo.Close(ctx); !errors.Is(err, errBoundToTx) {
+		t.Errorf("Close() = %v; want %v", err, errBoundToTx)
+	}
+	if err := repo.PingContext(ctx); !errors.Is(err, errBoundToTx) {
+		t.Errorf("PingContext() = %v; want %v", err, errBoundToTx)
+	}
+	if _, err := repo.GetSchemaVersion(ctx); !errors.Is(err, errBoundToTx) {
+		t.Errorf("GetSchemaVersion() = %v; want %v", err, errBoundToTx)
+	}
+
+	lock := repo.NewAdvisoryLock(1)
+	if acquired, err := lock.TryAcquire(ctx); acquired || !errors.Is(err, errBoundToTx) {
+		t.Errorf("TryAcquire() = %v, %v; want false, %v", acquired, err, errBoundToTx)
+	}
+	if err := lock.Acquire(ctx); !errors.Is(err, errBoundToTx) {
+		t.Errorf("Acquire() = %v; want %v", err, errBoundToTx)
+	}
+
+	// Returns at once, although the context is never cancelled
+	repo.ListenForChanges(ctx, func(events.Event) {
+		t.Error("handler called")
+	})
+}
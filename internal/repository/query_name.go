@@ -0,0 +1,19 @@
+package repository
+
+import "strings"
+
+// Name of queries not generated by sqlc
+const OtherQuery = "other"
+
+// QueryName returns the name sqlc puts in the leading "-- name: GetUser :one" comment
+func QueryName(sql string) string {
+	rest, ok := strings.CutPrefix(sql, "-- name: ")
+	if !ok {
+		return OtherQuery
+	}
+	name, _, ok := strings.Cut(rest, " ")
+	if !ok || name == "" {
+		return OtherQuery
+	}
+	return name
+}
@@ -0,0 +1,20 @@
+package repository
+
+import "testing"
+
+func TestQueryName(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected string
+	}{
+		{"-- name: GetUserBySyncCode :one\nSELECT 1", "GetUserBySyncCode"},
+		{"SELECT version, dirty FROM schema_migrations", OtherQuery},
+		{"-- name: ", OtherQuery},
+	}
+
+	for _, test := range tests {
+		if name := QueryName(test.sql); name != test.expected {
+			t.Errorf("QueryName(%q) = %q; want %q", test.sql, name, test.expected)
+		}
+	}
+}
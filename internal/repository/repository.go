@@ -2,7 +2,7 @@ package repository
 
 import (
 	"context"
-	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/spacecowboy/feeder-sync/build/gen/db"
@@ -10,22 +10,67 @@ import (
 
 type Repository interface {
 	Close(ctx context.Context) error
+	// Runs fn in a single transaction, which is committed if fn returns nil and rolled back otherwise.
+	// The repository given to fn must only be used inside fn, and not concurrently.
+	// Changes are notified to other instances once committed. Nested calls use savepoints.
+	WithTx(ctx context.Context, fn func(repo Repository) error) error
 	RegisterNewUser(ctx context.Context, deviceName string) (UserAndDevice, error)
 	AddDeviceToUser(ctx context.Context, user db.User, deviceName string) (db.Device, error)
 	GetDevices(ctx context.Context, user db.User) ([]db.Device, error)
 	// GetLegacyDevice(ctx context.Context, syncCode string, deviceId int64) (UserAndDevice, error)
-	GetDevicesEtag(ctx context.Context, user db.User) (string, error)
+	// Changes whenever anything shown about the user's devices changes.
+	// Devices not seen since staleBefore are considered stale.
+	GetDevicesEtag(ctx context.Context, user db.User, staleBefore time.Time) (string, error)
 	// RemoveDeviceWithLegacy(ctx context.Context, userDbId int64, legacyDeviceId int64) (int64, error)
-	UpdateLastSeenForDevice(ctx context.Context, device db.Device) error
+	// Sets when devices, by db id, were last seen in a single statement. Never moves last seen backwards.
+	UpdateLastSeen(ctx context.Context, lastSeen map[int64]time.Time) error
 	GetArticlesUpdatedSince(ctx context.Context, user db.User, sinceMillis int64) ([]db.Article, error)
-	AddArticle(ctx context.Context, user db.User, identifier string) (db.Article, error)
+	// Adds all read marks in a single statement. Read marks the user already has are skipped.
+	// Returns the number of read marks which were new.
+	AddArticles(ctx context.Context, user db.User, identifiers []string) (int64, error)
 	// AddLegacyArticle(ctx context.Context, userDbId int64, identifier string) error
 	GetLegacyFeeds(ctx context.Context, user db.User) (db.LegacyFeed, error)
 	UpdateLegacyFeeds(ctx context.Context, user db.User, contentHash int64, content string, etag string) (int64, error)
+	// Newest first
+	GetLegacyFeedsVersions(ctx context.Context, user db.User) ([]db.LegacyFeedsVersion, error)
+	// Deletes all but the newest maxVersions versions, and the versions which don't fit in maxBytes
+	// along with the current feeds and newer versions. Zero or less means unlimited.
+	// Returns the number of deleted versions.
+	PruneLegacyFeedsVersions(ctx context.Context, user db.User, maxVersions int, maxBytes int64) (int64, error)
+	// Moves the devices, read marks and feeds of the source chain into the target chain, then deletes the source.
+	// Both feeds are kept as versions. The target's feeds stay current, unless it has none.
+	// The sync code and user id of the source keep working as aliases of the target.
+	MergeChains(ctx context.Context, target db.User, source db.User) (MergeResult, error)
+	// Resolves the user and the device in a single round trip.
+	// Returns ErrNoSuchUser or ErrNoSuchDevice if either is unknown.
+	AuthenticateDevice(ctx context.Context, credentials DeviceCredentials) (UserAndDevice, error)
 	GetUserByUserId(ctx context.Context, userId uuid.UUID) (db.User, error)
 	GetUserBySyncCode(ctx context.Context, syncCode string) (db.User, error)
 	GetDeviceWithLegacyId(ctx context.Context, user db.User, legacyDeviceId int64) (db.Device, error)
 	RemoveDeviceWithLegacyId(ctx context.Context, user db.User, legacyDeviceId int64) (int, error)
+	// Removes the device from its chain. If no devices remain, the chain is deleted with all its data.
+	// Returns true if the chain was deleted.
+	LeaveChain(ctx context.Context, user db.User, device db.Device) (bool, error)
+	// Updates the non-nil fields of the user's device
+	UpdateDevice(ctx context.Context, user db.User, deviceId uuid.UUID, update DeviceUpdate) (db.Device, error)
+	// Deletes up to batchSize read marks, of any user, read before the given time.
+	// Returns the number of deleted read marks.
+	PruneReadMarks(ctx context.Context, readBefore time.Time, batchSize int32) (int64, error)
+	// Deletes up to batchSize devices, of any user, not seen since the given time.
+	// Users left without any devices, by this or an earlier call, are deleted as well.
+	ReapDevices(ctx context.Context, notSeenSince time.Time, batchSize int32) (ReapedDevices, error)
+	// Sets the UnifiedPush endpoint of the device. An empty endpoint unregisters the device.
+	SetPushEndpoint(ctx context.Context, device db.Device, endpoint string) error
+	// Returns the push endpoints of all the user's devices except the given one
+	GetPushEndpoints(ctx context.Context, userDbID int64, exceptDeviceDbID int64) ([]db.GetPushEndpointsRow, error)
+	// Unregisters the endpoint from the device, unless the device has registered a different endpoint since
+	ClearPushEndpoint(ctx context.Context, deviceDbID int64, endpoint string) error
+	// Locks the users until the transaction of WithTx ends, so that checking a quota and
+	// storing more can't interleave with another request of the same users.
+	// Returns ErrNoSuchUser if any of them no longer exists.
+	LockUsers(ctx context.Context, users ...db.User) error
+	// Returns how much the user currently stores on the server
+	GetUsage(ctx context.Context, user db.User) (Usage, error)
 
 	// Inserts a new user and device with the given legacy values if not already exists.
 	// NOOP if already exists.
@@ -42,6 +87,9 @@ type Repository interface {
 	AcceptLegacyFeeds(ctx context.Context, feeds *db.LegacyFeed) error
 	// For health check
 	PingContext(ctx context.Context) error
+	// For readiness check. Returns ErrNoSchemaVersion if no migration has been applied.
+	GetSchemaVersion(ctx context.Context) (SchemaVersion, error)
+	PoolStats() PoolStats
 }
 
 type UserAndDevice struct {
@@ -49,6 +97,57 @@ type UserAndDevice struct {
 	Device db.Device
 }
 
-var ErrNoReadMarks = errors.New("repository: no read marks")
-var ErrNoFeeds = errors.New("repository: no feeds")
-var ErrNoSuchDevice = errors.New("repository: no such device")
+// Usage is what a single user currently stores on the server
+type Usage struct {
+	ReadMarks int64
+	Devices   int64
+	// The current feeds and their earlier versions
+	FeedsBytes int64
+}
+
+// Identifies a device. The user is identified by either UserId or SyncCode.
+type DeviceCredentials struct {
+	UserId         *uuid.UUID
+	SyncCode       string
+	LegacyDeviceId int64
+}
+
+type MergeResult struct {
+	// Devices moved from the source
+	Devices int64
+	// Read marks moved from the source which the target didn't already have
+	ReadMarks int64
+	// Feeds kept as versions, before the oldest versions beyond the limits are pruned
+	FeedsVersions int64
+}
+
+// Nil fields are left unchanged
+type DeviceUpdate struct {
+	DeviceName *string
+	Platform   *string
+	AppVersion *string
+}
+
+type ReapedDevices struct {
+	Devices int64
+	Users   int64
+}
+
+// SchemaVersion is the migration state recorded by golang-migrate
+type SchemaVersion struct {
+	Version int64
+	// A migration failed half-way
+	Dirty bool
+}
+
+// PoolStats is a snapshot of the database connection pool
+type PoolStats struct {
+	AcquiredConns int32
+	IdleConns     int32
+	TotalConns    int32
+	MaxConns      int32
+	// Acquires which had to wait for a connection, since the pool was created
+	EmptyAcquireCount int64
+	// Total time spent acquiring connections, since the pool was created
+	AcquireDuration time.Duration
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spacecowboy/feeder-sync/internal/problems"
+)
+
+// Limits bounds how much a single user can store on the server.
+// A value of zero or less means that dimension is unlimited.
+type Limits struct {
+	// Total number of read marks stored for a user
+	MaxReadMarks int64
+	// Number of read marks accepted in a single request
+	MaxReadMarksPerRequest int
+	// Length in bytes of a single (encrypted) read mark identifier
+	MaxIdentifierLength int
+	// Size in bytes of the (encrypted) feeds blob, together with its earlier versions
+	MaxFeedsBytes int64
+	// Number of earlier versions of the feeds kept. The oldest are pruned first,
+	// also when they don't fit in MaxFeedsBytes.
+	MaxFeedsVersions int
+	// Number of devices in a single chain
+	MaxDevices int64
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxReadMarks:           100_000,
+		MaxReadMarksPerRequest: 1_000,
+		MaxIdentifierLength:    4096,
+		MaxFeedsBytes:          5 * 1024 * 1024,
+		MaxFeedsVersions:       10,
+		MaxDevices:             50,
+	}
+}
+
+// Slack added on top of MaxFeedsBytes to allow for the JSON around the blob
+const feedsRequestOverheadBytes = 4096
+
+func exceeds(used int64, limit int64) bool {
+	return limit > 0 && used > limit
+}
+
+func abortPayloadTooLarge(c *gin.Context, quota string, limit int64) {
+	problems.Abort(c, problems.New(http.StatusRequestEntityTooLarge, problems.PayloadTooLarge, "Payload too large").
+		With("quota", quota).
+		With("limit", limit))
+}
+
+func abortQuotaExceeded(c *gin.Context, quota string, limit int64) {
+	problems.Abort(c, problems.New(http.StatusUnprocessableEntity, problems.QuotaExceeded, "Quota exceeded").
+		With("quota", quota).
+		With("limit", limit))
+}
+
+// Returned from inside WithTx, so that what was stored is rolled back
+type quotaExceededError struct {
+	quota string
+	limit int64
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("quota %s of %d exceeded", e.quota, e.limit)
+}
+
+// Aborts with quotaExceeded if a quota was exceeded, and as AbortWithError otherwise
+func abortWithQuotaError(c *gin.Context, err error) {
+	var quotaErr *quotaExceededError
+	if errors.As(err, &quotaErr) {
+		abortQuotaExceeded(c, quotaErr.quota, quotaErr.limit)
+		return
+	}
+	problems.AbortWithError(c, err)
+}
+
+func isMaxBytesError(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
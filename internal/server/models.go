@@ -18,6 +18,8 @@ type JoinChainResponseV1 struct {
 type DeviceMessageV1 struct {
 	DeviceId   int64  `json:"deviceId"`
 	DeviceName string `json:"deviceName"`
+	// Device has not been seen in a long time. Omitted when false.
+	Stale bool `json:"stale,omitempty"`
 }
 
 type DeviceListResponseV1 struct {
@@ -70,6 +72,33 @@ type UserDeviceResponseV2 struct {
 	DeviceName string    `json:"deviceName"`
 }
 
+// Omitted fields are left unchanged
+type UpdateDeviceRequestV2 struct {
+	DeviceName *string `json:"deviceName"`
+	Platform   *string `json:"platform"`
+	AppVersion *string `json:"appVersion"`
+}
+
+type DeviceMessageV2 struct {
+	DeviceId       uuid.UUID `json:"deviceId"`
+	LegacyDeviceId int64     `json:"legacyDeviceId"`
+	DeviceName     string    `json:"deviceName"`
+	Platform       string    `json:"platform"`
+	AppVersion     string    `json:"appVersion"`
+	// Milliseconds
+	LastSeen int64 `json:"lastSeen"`
+	// Milliseconds. Omitted for devices registered before this was recorded.
+	RegisteredAt *int64 `json:"registeredAt,omitempty"`
+	// The device making the request
+	Current bool `json:"current"`
+	// Device has not been seen in a long time
+	Stale bool `json:"stale"`
+}
+
+type DeviceListResponseV2 struct {
+	Devices []DeviceMessageV2 `json:"devices"`
+}
+
 type CreateChainRequestV2 struct {
 	DeviceName string `json:"deviceName"`
 }
@@ -78,3 +107,103 @@ type JoinChainRequestV2 struct {
 	UserId     uuid.UUID `json:"userId"`
 	DeviceName string    `json:"deviceName"`
 }
+
+// Limit of zero means unlimited
+type QuotaV2 struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+type UsageResponseV2 struct {
+	ReadMarks              QuotaV2 `json:"readMarks"`
+	FeedsBytes             QuotaV2 `json:"feedsBytes"`
+	Devices                QuotaV2 `json:"devices"`
+	MaxReadMarksPerRequest int     `json:"maxReadMarksPerRequest"`
+	MaxIdentifierLength    int     `json:"maxIdentifierLength"`
+}
+
+// Sent on the events stream. Type is one of "readmarks", "feeds" or "devices".
+// Type "removed" is sent, right before the stream ends, if the device has been removed from the chain.
+// Type "merged" is sent, right before the stream ends, if the chain has been merged into another chain.
+// The device should reconnect, and fetch everything again.
+type EventMessageV2 struct {
+	Type string `json:"type"`
+}
+
+// UnifiedPush endpoint which the server POSTs to when another device changes something
+type PushEndpointRequestV2 struct {
+	Endpoint string `json:"endpoint"`
+}
+
+type LeaveChainResponseV2 struct {
+	// True if this was the last device, and the chain was deleted with all its data
+	ChainDeleted bool `json:"chainDeleted"`
+}
+
+type MergeChainsRequestV2 struct {
+	// Sync code of the chain to merge into the caller's chain
+	SyncCode string `json:"syncCode"`
+}
+
+type MergeChainsResponseV2 struct {
+	Devices       int64 `json:"devices"`
+	ReadMarks     int64 `json:"readMarks"`
+	FeedsVersions int64 `json:"feedsVersions"`
+}
+
+type FeedsVersionV2 struct {
+	ContentHash int64  `json:"hash"`
+	Encrypted   string `json:"encrypted"`
+	Etag        string `json:"etag"`
+	// Milliseconds since epoch
+	CreatedAt int64 `json:"createdAt"`
+}
+
+type FeedsVersionsResponseV2 struct {
+	Versions []FeedsVersionV2 `json:"versions"`
+}
+
+// Shown to anyone without the admin or metrics token
+type ReadinessStatusResponse struct {
+	Status string `json:"status"`
+}
+
+type ReadinessResponse struct {
+	// "Ready" only if every check is ok
+	Status   string        `json:"status"`
+	Database DatabaseCheck `json:"database"`
+	Schema   SchemaCheck   `json:"schema"`
+	Pool     PoolCheck     `json:"pool"`
+}
+
+type DatabaseCheck struct {
+	Ok            bool   `json:"ok"`
+	LatencyMillis int64  `json:"latencyMs"`
+	Error         string `json:"error,omitempty"`
+}
+
+type SchemaCheck struct {
+	Ok bool `json:"ok"`
+	// Zero if not migrated
+	Version         int64  `json:"version"`
+	ExpectedVersion uint   `json:"expectedVersion"`
+	Dirty           bool   `json:"dirty"`
+	Error           string `json:"error,omitempty"`
+	// Set when the schema is newer than expected, which is not an error
+	Warning string `json:"warning,omitempty"`
+}
+
+// Saturation is reported but doesn't make the server unready
+type PoolCheck struct {
+	Acquired int32 `json:"acquired"`
+	Idle     int32 `json:"idle"`
+	Total    int32 `json:"total"`
+	Max      int32 `json:"max"`
+	// Acquired connections relative to the maximum, between 0 and 1
+	Utilization float64 `json:"utilization"`
+	// Every connection is in use, so further queries wait
+	Saturated bool `json:"saturated"`
+	// Since the server started
+	EmptyAcquireCount     int64 `json:"emptyAcquireCount"`
+	AcquireDurationMillis int64 `json:"acquireDurationMs"`
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/internal/events"
+	"github.com/spacecowboy/feeder-sync/internal/jobs"
+	"github.com/spacecowboy/feeder-sync/internal/metrics"
+)
+
+// ServerOption customizes a FeederServer on creation
+type ServerOption func(*FeederServer)
+
+func WithLimits(limits Limits) ServerOption {
+	return func(s *FeederServer) {
+		s.limits = limits
+	}
+}
+
+// Devices not seen for the given duration are marked as stale. Zero disables the marker.
+func WithDeviceStaleAfter(staleAfter time.Duration) ServerOption {
+	return func(s *FeederServer) {
+		s.deviceStaleAfter = staleAfter
+	}
+}
+
+// Admin endpoints are only enabled when a token is set
+func WithAdminToken(token string) ServerOption {
+	return func(s *FeederServer) {
+		s.adminToken = token
+	}
+}
+
+// Credentials clients must send with every API request
+func WithBasicAuth(user string, password string) ServerOption {
+	return func(s *FeederServer) {
+		s.basicAuthUser = user
+		s.basicAuthPassword = password
+	}
+}
+
+// Exposes the status of background jobs on the admin endpoint
+func WithScheduler(scheduler *jobs.Scheduler) ServerOption {
+	return func(s *FeederServer) {
+		s.scheduler = scheduler
+	}
+}
+
+// Change notifications are published to, and streamed from, the given broker
+func WithBroker(broker *events.Broker) ServerOption {
+	return func(s *FeederServer) {
+		s.broker = broker
+	}
+}
+
+// How often last seen times of devices are written to the database
+func WithLastSeenFlushInterval(interval time.Duration) ServerOption {
+	return func(s *FeederServer) {
+		s.lastSeenFlushInterval = interval
+	}
+}
+
+// Records metrics to the given registry instead of a new one
+func WithMetrics(m *metrics.Metrics) ServerOption {
+	return func(s *FeederServer) {
+		s.metrics = m
+	}
+}
+
+// Push endpoints must point to one of the hosts, or a subdomain of one. Any public host is allowed if empty.
+func WithPushAllowedHosts(hosts []string) ServerOption {
+	return func(s *FeederServer) {
+		s.pushAllowedHosts = hosts
+	}
+}
+
+// The metrics endpoint is only enabled when a token is set
+func WithMetricsToken(token string) ServerOption {
+	return func(s *FeederServer) {
+		s.metricsToken = token
+	}
+}
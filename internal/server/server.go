@@ -2,91 +2,211 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/spacecowboy/feeder-sync/build/gen/db"
+	"github.com/spacecowboy/feeder-sync/internal/events"
+	"github.com/spacecowboy/feeder-sync/internal/jobs"
+	"github.com/spacecowboy/feeder-sync/internal/lastseen"
+	"github.com/spacecowboy/feeder-sync/internal/logging"
+	"github.com/spacecowboy/feeder-sync/internal/metrics"
 	"github.com/spacecowboy/feeder-sync/internal/middleware"
+	"github.com/spacecowboy/feeder-sync/internal/migrations"
+	"github.com/spacecowboy/feeder-sync/internal/problems"
+	"github.com/spacecowboy/feeder-sync/internal/push"
 	"github.com/spacecowboy/feeder-sync/internal/repository"
+	"github.com/spacecowboy/feeder-sync/internal/tracing"
 )
 
+// Milliseconds. Read marks read before this time have been deleted by the server.
+const READMARKS_PRUNED_BEFORE_HEADER = "X-FEEDER-READMARKS-PRUNED-BEFORE"
+
+const DefaultDeviceStaleAfter = 90 * 24 * time.Hour
+
 type FeederServer struct {
 	repo   repository.Repository
 	Router *gin.Engine
+	limits Limits
+	// Devices not seen for this long are marked as stale
+	deviceStaleAfter  time.Duration
+	adminToken        string
+	basicAuthUser     string
+	basicAuthPassword string
+	scheduler         *jobs.Scheduler
+	broker            *events.Broker
+	metrics           *metrics.Metrics
+	metricsToken      string
+	// Hosts push endpoints may point to. Any public host if empty.
+	pushAllowedHosts []string
+	// Newest embedded migration, which the database must be at to be ready
+	expectedSchemaVersion uint
+	// Last seen times of devices are written in batches
+	lastSeen              *lastseen.Tracker
+	lastSeenFlushInterval time.Duration
+	// Background work started by the server itself, stopped on Close
+	backgroundCtx  context.Context
+	stopBackground context.CancelFunc
+	background     sync.WaitGroup
 }
 
-func NewServerWithPostgres(connString string) (*FeederServer, error) {
+func NewServerWithPostgres(connString string, options ...ServerOption) (*FeederServer, error) {
 	ctx := context.Background()
 
-	pool, err := pgxpool.New(ctx, connString)
+	poolConfig, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	m := metrics.New()
+	poolConfig.ConnConfig.Tracer = tracing.QueryTracer(m.QueryTracer())
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
 		return nil, err
 	}
+	options = append([]ServerOption{WithMetrics(m)}, options...)
 
 	repo := repository.NewPostgresRepository(pool)
+	cachedRepo := repository.NewCachedRepository(repo, repository.DefaultCacheSize, repository.DefaultCacheTTL)
+
+	server, err := NewServerWithRepo(cachedRepo, options...)
+	if err != nil {
+		return nil, err
+	}
 
-	return NewServerWithRepo(repo)
+	// Changes made by any instance are streamed to devices connected to this one
+	server.runInBackground(func(ctx context.Context) {
+		repo.ListenForChanges(ctx, func(event events.Event) {
+			// Before publishing, so that subscribers see the change
+			cachedRepo.Invalidate(event)
+			server.broker.Publish(event)
+		})
+	})
+
+	return server, nil
 }
 
-func NewServerWithRepo(repo repository.Repository) (*FeederServer, error) {
+func NewServerWithRepo(repo repository.Repository, options ...ServerOption) (*FeederServer, error) {
 	router := gin.New()
+	// Lets the repository see values set on the request context by middleware
+	router.ContextWithFallback = true
 	router.Use(
-		// Don't log health and ready endpoints
-		gin.LoggerWithWriter(gin.DefaultWriter, "/health", "/ready"),
-		gin.Recovery(),
+		// First, so that the span covers everything below
+		tracing.Middleware(),
+		// Don't log health, ready and metrics endpoints
+		logging.Middleware("/health", "/ready", "/metrics"),
+		logging.Recovery(),
 	)
 
 	server := FeederServer{
-		repo:   repo,
-		Router: router,
+		repo:                  repo,
+		Router:                router,
+		limits:                DefaultLimits(),
+		deviceStaleAfter:      DefaultDeviceStaleAfter,
+		broker:                events.NewBroker(),
+		lastSeenFlushInterval: lastseen.DefaultFlushInterval,
+		basicAuthUser:         middleware.HARDCODED_USER,
+		basicAuthPassword:     middleware.HARDCODED_PASSWORD,
+		metrics:               metrics.New(),
+	}
+
+	for _, option := range options {
+		option(&server)
+	}
+
+	expectedSchemaVersion, err := migrations.LatestVersion()
+	if err != nil {
+		return nil, err
 	}
+	server.expectedSchemaVersion = expectedSchemaVersion
+
+	router.Use(server.metrics.Middleware())
+	server.metrics.RegisterPool(repo.PoolStats)
+
+	server.backgroundCtx, server.stopBackground = context.WithCancel(context.Background())
+	server.lastSeen = lastseen.NewTracker(repo, server.lastSeenFlushInterval)
+	server.runInBackground(server.lastSeen.Run)
 
 	// Middleware
-	assertBasicAuth := middleware.AssertBasicAuth()
-	assertUser := middleware.AssertRegisteredUser(repo)
-	assertDevice := middleware.AssertRegisteredDevice(repo)
-	updateLastSeen := middleware.UpdateLastSeenForDevice(repo)
+	assertBasicAuth := tracing.Handler("assertBasicAuth", middleware.AssertBasicAuth(server.basicAuthUser, server.basicAuthPassword))
+	assertAdmin := tracing.Handler("assertAdmin", middleware.AssertAdminToken(server.adminToken))
+	// Kept apart from the admin token, as scrapers only need read access to metrics
+	assertMetrics := tracing.Handler("assertMetrics", middleware.AssertAdminToken(server.metricsToken))
+	assertUser := tracing.Handler("assertUser", middleware.AssertRegisteredUser(repo))
+	assertDevice := tracing.Handler("assertDevice", middleware.AssertRegisteredDevice(repo, server.lastSeen))
 
 	// These have no middleware
-	router.GET("/health", server.handleHealth)
-	router.GET("/ready", server.handleReady)
+	router.GET("/health", tracing.Handler("handleHealth", server.handleHealth))
+	router.GET("/ready", tracing.Handler("handleReady", server.handleReady))
+	router.GET("/metrics", assertMetrics, tracing.Handler("metrics", gin.WrapH(server.metrics.Handler())))
+
+	admin := router.Group("/admin", assertAdmin)
+	{
+		admin.GET("jobs", tracing.Handler("handleJobsStatus", server.handleJobsStatus))
+	}
 
 	// Create only checks auth
 	apiKeyOnly := router.Group("/api", assertBasicAuth)
 	{
-		apiKeyOnly.POST("v1/create", server.handleCreateV1)
-		apiKeyOnly.POST("v2/create", server.handleCreateV2)
+		apiKeyOnly.POST("v1/create", tracing.Handler("handleCreateV1", server.handleCreateV1))
+		apiKeyOnly.POST("v2/create", tracing.Handler("handleCreateV2", server.handleCreateV2))
 	}
 
 	// auth and UserID
 	apiKeyUserId := router.Group("/api", assertBasicAuth, assertUser)
 	{
-		apiKeyUserId.POST("v1/join", server.handleJoinV1)
-		apiKeyUserId.POST("v2/join", server.handleJoinV2)
+		apiKeyUserId.POST("v1/join", tracing.Handler("handleJoinV1", server.handleJoinV1))
+		apiKeyUserId.POST("v2/join", tracing.Handler("handleJoinV2", server.handleJoinV2))
 	}
 
 	// auth, userid, deviceid
-	fullyAuthed := router.Group("/api", assertBasicAuth, assertUser, assertDevice, updateLastSeen)
+	fullyAuthed := router.Group("/api", assertBasicAuth, assertDevice)
 	{
-		fullyAuthed.GET("v1/ereadmark", server.handleGETReadmarkV1)
-		fullyAuthed.POST("v1/ereadmark", server.handlePOSTReadmarkV1)
-		fullyAuthed.GET("v1/devices", server.handleDeviceGetV1)
-		fullyAuthed.DELETE("v1/devices/:id", server.handleDeviceDeleteV1)
-		fullyAuthed.GET("v1/feeds", server.handleGETFeedsV1)
-		fullyAuthed.POST("v1/feeds", server.handlePOSTFeedsV1)
+		fullyAuthed.GET("v1/ereadmark", tracing.Handler("handleGETReadmarkV1", server.handleGETReadmarkV1))
+		fullyAuthed.POST("v1/ereadmark", tracing.Handler("handlePOSTReadmarkV1", server.handlePOSTReadmarkV1))
+		fullyAuthed.GET("v1/devices", tracing.Handler("handleDeviceGetV1", server.handleDeviceGetV1))
+		fullyAuthed.DELETE("v1/devices/:id", tracing.Handler("handleDeviceDeleteV1", server.handleDeviceDeleteV1))
+		fullyAuthed.GET("v1/feeds", tracing.Handler("handleGETFeedsV1", server.handleGETFeedsV1))
+		fullyAuthed.POST("v1/feeds", tracing.Handler("handlePOSTFeedsV1", server.handlePOSTFeedsV1))
+		fullyAuthed.GET("v2/usage", tracing.Handler("handleUsageV2", server.handleUsageV2))
+		fullyAuthed.GET("v2/events", tracing.Handler("handleEventsV2", server.handleEventsV2))
+		fullyAuthed.GET("v2/devices", tracing.Handler("handleDeviceGetV2", server.handleDeviceGetV2))
+		fullyAuthed.PATCH("v2/devices/:id", tracing.Handler("handleDevicePatchV2", server.handleDevicePatchV2))
+		fullyAuthed.POST("v2/leave", tracing.Handler("handleLeaveV2", server.handleLeaveV2))
+		fullyAuthed.POST("v2/merge", tracing.Handler("handleMergeV2", server.handleMergeV2))
+		fullyAuthed.GET("v2/feeds/versions", tracing.Handler("handleFeedsVersionsV2", server.handleFeedsVersionsV2))
+		fullyAuthed.PUT("v2/push", tracing.Handler("handlePUTPushV2", server.handlePUTPushV2))
+		fullyAuthed.DELETE("v2/push", tracing.Handler("handleDELETEPushV2", server.handleDELETEPushV2))
 	}
 
 	return &server, nil
 }
 
+// Runs fn until the server is closed. Close waits for fn to return.
+func (s *FeederServer) runInBackground(fn func(ctx context.Context)) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		fn(s.backgroundCtx)
+	}()
+}
+
 func (s *FeederServer) Close() error {
+	s.stopBackground()
+	// Pending last seen times are flushed before the repository is closed
+	s.background.Wait()
+	s.broker.Close()
 	return s.repo.Close(context.Background())
 }
 
@@ -109,18 +229,92 @@ func (s *FeederServer) handleHealth(c *gin.Context) {
 func (s *FeederServer) handleReady(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c, 1*time.Second)
 	defer cancel()
-	// Check if the database connection is alive
-	if err := s.repo.PingContext(ctx); err != nil {
-		log.Printf("Database connection is not ready: %s", err.Error())
-		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
-			"status": "Database connection is not ready",
-		})
+
+	response := ReadinessResponse{
+		Status:   "Ready",
+		Database: s.checkDatabase(ctx),
+		Schema:   s.checkSchema(ctx),
+		Pool:     s.checkPool(),
+	}
+
+	status := http.StatusOK
+	if !response.Database.Ok || !response.Schema.Ok {
+		response.Status = "Not ready"
+		status = http.StatusServiceUnavailable
+	}
+
+	// Probes only need the status. The details are for operators.
+	if !middleware.HasBearerToken(c, s.adminToken) && !middleware.HasBearerToken(c, s.metricsToken) {
+		c.JSON(status, ReadinessStatusResponse{Status: response.Status})
 		return
 	}
+	c.JSON(status, response)
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status": "Ready",
-	})
+// Details of failures are logged rather than shown to anyone calling the endpoint
+func (s *FeederServer) checkDatabase(ctx context.Context) DatabaseCheck {
+	start := time.Now()
+	err := s.repo.PingContext(ctx)
+	check := DatabaseCheck{
+		Ok:            err == nil,
+		LatencyMillis: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Database connection is not ready", "error", err)
+		check.Error = "Database connection is not ready"
+	}
+	return check
+}
+
+func (s *FeederServer) checkSchema(ctx context.Context) SchemaCheck {
+	check := SchemaCheck{ExpectedVersion: s.expectedSchemaVersion}
+
+	version, err := s.repo.GetSchemaVersion(ctx)
+	switch {
+	case errors.Is(err, repository.ErrNoSchemaVersion):
+		check.Error = "Database is not migrated"
+	case err != nil:
+		slog.ErrorContext(ctx, "Failed to read schema version", "error", err)
+		check.Error = "Failed to read schema version"
+	case version.Dirty:
+		check.Error = "A migration failed and must be fixed by hand"
+	case version.Version < int64(s.expectedSchemaVersion):
+		check.Error = fmt.Sprintf("Schema version is %d, expected %d", version.Version, s.expectedSchemaVersion)
+	case version.Version > int64(s.expectedSchemaVersion):
+		// Migrations are applied before a rollout, so older instances keep serving until replaced
+		check.Warning = fmt.Sprintf("Schema version is %d, newer than expected %d", version.Version, s.expectedSchemaVersion)
+	}
+
+	check.Ok = check.Error == ""
+	check.Version = version.Version
+	check.Dirty = version.Dirty
+	return check
+}
+
+func (s *FeederServer) checkPool() PoolCheck {
+	stats := s.repo.PoolStats()
+	check := PoolCheck{
+		Acquired:              stats.AcquiredConns,
+		Idle:                  stats.IdleConns,
+		Total:                 stats.TotalConns,
+		Max:                   stats.MaxConns,
+		Saturated:             stats.MaxConns > 0 && stats.AcquiredConns >= stats.MaxConns,
+		EmptyAcquireCount:     stats.EmptyAcquireCount,
+		AcquireDurationMillis: stats.AcquireDuration.Milliseconds(),
+	}
+	if stats.MaxConns > 0 {
+		check.Utilization = float64(stats.AcquiredConns) / float64(stats.MaxConns)
+	}
+	return check
+}
+
+func (s *FeederServer) handleJobsStatus(c *gin.Context) {
+	if s.scheduler == nil {
+		c.JSON(http.StatusOK, jobs.Status{Jobs: []jobs.JobStatus{}})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.scheduler.Status())
 }
 
 func matchesEtag(requestEtag string, etagValue string) bool {
@@ -144,26 +338,36 @@ func etagValueForInt64(data int64) string {
 func (s *FeederServer) handleDeviceGetV1(c *gin.Context) {
 	user := c.MustGet("user").(db.User)
 
-	etag, err := s.repo.GetDevicesEtag(c, user)
+	etag, err := s.repo.GetDevicesEtag(c, user, s.staleBefore())
 	if err != nil {
-		log.Printf("GetLegacyDevicesEtag error: %s", err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Something bad"})
+		problems.AbortWithError(c, err)
 		return
 	}
 
 	requestEtag := c.GetHeader("If-None-Match")
-	if matchesEtag(requestEtag, etag) {
+	matched := matchesEtag(requestEtag, etag)
+	if requestEtag != "" {
+		s.metrics.EtagChecked("devices", matched)
+	}
+	if matched {
 		c.Status(http.StatusNotModified)
 		return
 	}
 
 	devices, err := s.repo.GetDevices(c, user)
 	if err != nil {
-		log.Printf("Failed to fetch devices for user %s: %s", user.UserID, err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Something bad"})
+		problems.AbortWithError(c, err)
 		return
 	}
 
+	response := s.deviceListResponseV1(devices)
+
+	c.Header("Cache-Control", "private, must-revalidate")
+	c.Header("ETag", etag)
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *FeederServer) deviceListResponseV1(devices []db.Device) DeviceListResponseV1 {
 	response := DeviceListResponseV1{
 		Devices: make([]DeviceMessageV1, 0, len(devices)),
 	}
@@ -174,14 +378,26 @@ func (s *FeederServer) handleDeviceGetV1(c *gin.Context) {
 			DeviceMessageV1{
 				DeviceId:   device.LegacyDeviceID,
 				DeviceName: device.DeviceName,
+				Stale:      s.isStale(device),
 			},
 		)
 	}
 
-	c.Header("Cache-Control", "private, must-revalidate")
-	log.Printf("Setting ETag: %s", etag)
-	c.Header("ETag", etag)
-	c.JSON(http.StatusOK, response)
+	return response
+}
+
+// A device is stale if it has not been seen for a long time
+func (s *FeederServer) isStale(device db.Device) bool {
+	return device.LastSeen.Valid && device.LastSeen.Time.Before(s.staleBefore())
+}
+
+// Devices not seen since the returned time are stale
+func (s *FeederServer) staleBefore() time.Time {
+	if s.deviceStaleAfter <= 0 {
+		// No device is stale
+		return time.Time{}
+	}
+	return time.Now().Add(-s.deviceStaleAfter)
 }
 
 func (s *FeederServer) handleDeviceDeleteV1(c *gin.Context) {
@@ -189,69 +405,331 @@ func (s *FeederServer) handleDeviceDeleteV1(c *gin.Context) {
 
 	legacyDeviceIdString := c.Param("id")
 	if legacyDeviceIdString == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Bad Device ID"})
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidDeviceId, "Bad Device ID"))
 		return
 	}
 
 	legacyDeviceId, err := strconv.ParseInt(legacyDeviceIdString, 10, 64)
 	if err != nil {
-		log.Printf("Device Id was not a 64 bit number: %s", legacyDeviceIdString)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Bad Device ID"})
+		slog.DebugContext(c, "Device id is not a 64 bit number", "error", err)
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidDeviceId, "Bad Device ID"))
+		return
+	}
+
+	if legacyDeviceId == c.MustGet("device").(db.Device).LegacyDeviceID {
+		s.leaveChainV1(c)
+		return
+	}
+
+	// The etag and list must describe the state right after the delete
+	var removed int
+	var etag string
+	var devices []db.Device
+	err = s.repo.WithTx(c, func(tx repository.Repository) error {
+		var err error
+		removed, err = tx.RemoveDeviceWithLegacyId(c, user, legacyDeviceId)
+		if err != nil {
+			return err
+		}
+
+		etag, err = tx.GetDevicesEtag(c, user, s.staleBefore())
+		if err != nil {
+			return err
+		}
+
+		devices, err = tx.GetDevices(c, user)
+		return err
+	})
+	if err != nil {
+		problems.AbortWithError(c, err)
 		return
 	}
+	if removed > 0 {
+		s.metrics.DeviceLeft()
+	}
 
-	_, err = s.repo.RemoveDeviceWithLegacyId(c, user, legacyDeviceId)
+	response := s.deviceListResponseV1(devices)
+
+	c.Header("Cache-Control", "private, must-revalidate")
+	c.Header("ETag", etag)
+	c.JSON(http.StatusOK, response)
+}
+
+// Removing the calling device is the same as leaving the chain.
+// Responds with the devices which remain, if any.
+func (s *FeederServer) leaveChainV1(c *gin.Context) {
+	user := c.MustGet("user").(db.User)
+	device := c.MustGet("device").(db.Device)
+
+	var devices []db.Device
+	err := s.repo.WithTx(c, func(tx repository.Repository) error {
+		chainDeleted, err := tx.LeaveChain(c, user, device)
+		if err != nil || chainDeleted {
+			return err
+		}
+
+		devices, err = tx.GetDevices(c, user)
+		return err
+	})
 	if err != nil {
-		log.Printf("Failed to delete device %d: %s", legacyDeviceId, err.Error())
-		if err == repository.ErrNoSuchDevice {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No such device"})
-		} else {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Something bad"})
+		problems.AbortWithError(c, err)
+		return
+	}
+	s.metrics.DeviceLeft()
+
+	c.JSON(http.StatusOK, s.deviceListResponseV1(devices))
+}
+
+func (s *FeederServer) handleLeaveV2(c *gin.Context) {
+	user := c.MustGet("user").(db.User)
+	device := c.MustGet("device").(db.Device)
+
+	chainDeleted, err := s.repo.LeaveChain(c, user, device)
+	if err != nil {
+		problems.AbortWithError(c, err)
+		return
+	}
+	s.metrics.DeviceLeft()
+
+	c.JSON(http.StatusOK, LeaveChainResponseV2{ChainDeleted: chainDeleted})
+}
+
+func (s *FeederServer) handleMergeV2(c *gin.Context) {
+	user := c.MustGet("user").(db.User)
+
+	var mergeRequest MergeChainsRequestV2
+	if err := c.ShouldBindJSON(&mergeRequest); err != nil {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Bad body"))
+		return
+	}
+
+	if mergeRequest.SyncCode == "" {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.MissingSyncCode, "Missing syncCode"))
+		return
+	}
+
+	source, err := s.repo.GetUserBySyncCode(c, mergeRequest.SyncCode)
+	if err != nil {
+		problems.AbortWithError(c, err)
+		return
+	}
+
+	if source.DbID == user.DbID {
+		problems.AbortWithError(c, repository.ErrSameChain)
+		return
+	}
+
+	result, err := s.mergeWithinQuota(c, user, source)
+	if err != nil {
+		abortWithQuotaError(c, err)
+		return
+	}
+	s.metrics.ChainMerged()
+
+	c.JSON(http.StatusOK, MergeChainsResponseV2{
+		Devices:       result.Devices,
+		ReadMarks:     result.ReadMarks,
+		FeedsVersions: result.FeedsVersions,
+	})
+}
+
+// Merges the chains unless the merged chain would exceed a quota
+func (s *FeederServer) mergeWithinQuota(c *gin.Context, target db.User, source db.User) (repository.MergeResult, error) {
+	var result repository.MergeResult
+	err := s.repo.WithTx(c, func(tx repository.Repository) error {
+		// Neither chain can grow between the check and the merge
+		if err := tx.LockUsers(c, target, source); err != nil {
+			return err
+		}
+
+		targetUsage, err := tx.GetUsage(c, target)
+		if err != nil {
+			return err
+		}
+
+		sourceUsage, err := tx.GetUsage(c, source)
+		if err != nil {
+			return err
+		}
+
+		if exceeds(targetUsage.Devices+sourceUsage.Devices, s.limits.MaxDevices) {
+			return &quotaExceededError{quota: "devices", limit: s.limits.MaxDevices}
+		}
+
+		// Duplicates are merged, so this is an upper bound
+		if exceeds(targetUsage.ReadMarks+sourceUsage.ReadMarks, s.limits.MaxReadMarks) {
+			return &quotaExceededError{quota: "readMarks", limit: s.limits.MaxReadMarks}
+		}
+
+		result, err = tx.MergeChains(c, target, source)
+		if err != nil {
+			return err
+		}
+
+		// Both feeds were kept as versions
+		_, err = tx.PruneLegacyFeedsVersions(c, target, s.limits.MaxFeedsVersions, s.limits.MaxFeedsBytes)
+		return err
+	})
+	return result, err
+}
+
+func (s *FeederServer) handleFeedsVersionsV2(c *gin.Context) {
+	user := c.MustGet("user").(db.User)
+
+	versions, err := s.repo.GetLegacyFeedsVersions(c, user)
+	if err != nil {
+		problems.AbortWithError(c, err)
+		return
+	}
+
+	response := FeedsVersionsResponseV2{
+		Versions: make([]FeedsVersionV2, 0, len(versions)),
+	}
+	for _, version := range versions {
+		response.Versions = append(response.Versions, FeedsVersionV2{
+			ContentHash: version.ContentHash,
+			Encrypted:   version.Content,
+			Etag:        version.Etag,
+			CreatedAt:   version.CreatedAt.Time.UnixMilli(),
+		})
+	}
+
+	c.Header("Cache-Control", "private, no-cache")
+	c.JSON(http.StatusOK, response)
+}
+
+// Longest accepted device name, platform or app version
+const maxDeviceFieldLength = 256
+
+func (s *FeederServer) handleDevicePatchV2(c *gin.Context) {
+	user := c.MustGet("user").(db.User)
+
+	deviceId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidDeviceId, "Bad Device ID"))
+		return
+	}
+
+	var updateRequest UpdateDeviceRequestV2
+	if err := c.ShouldBindJSON(&updateRequest); err != nil {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Bad body"))
+		return
+	}
+
+	if updateRequest.DeviceName != nil && *updateRequest.DeviceName == "" {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.MissingDeviceName, "Missing deviceName"))
+		return
+	}
+
+	for _, field := range []*string{updateRequest.DeviceName, updateRequest.Platform, updateRequest.AppVersion} {
+		if field != nil && len(*field) > maxDeviceFieldLength {
+			problems.Abort(c, problems.New(http.StatusBadRequest, problems.ValueTooLong, "Value too long"))
+			return
+		}
+	}
+
+	var device db.Device
+	var etag string
+	err = s.repo.WithTx(c, func(tx repository.Repository) error {
+		var err error
+		device, err = tx.UpdateDevice(c, user, deviceId, repository.DeviceUpdate{
+			DeviceName: updateRequest.DeviceName,
+			Platform:   updateRequest.Platform,
+			AppVersion: updateRequest.AppVersion,
+		})
+		if err != nil {
+			return err
 		}
+
+		etag, err = tx.GetDevicesEtag(c, user, s.staleBefore())
+		return err
+	})
+	if err != nil {
+		problems.AbortWithError(c, err)
+		return
+	}
+
+	response, err := s.deviceMessageV2(device, c.MustGet("device").(db.Device))
+	if err != nil {
+		problems.AbortWithError(c, err)
 		return
 	}
 
+	c.Header("ETag", etag)
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *FeederServer) handleDeviceGetV2(c *gin.Context) {
+	user := c.MustGet("user").(db.User)
+	current := c.MustGet("device").(db.Device)
+
 	devices, err := s.repo.GetDevices(c, user)
 	if err != nil {
-		log.Printf("Failed to fetch devices for user %s: %s", user.UserID, err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Something bad"})
+		problems.AbortWithError(c, err)
 		return
 	}
 
-	response := DeviceListResponseV1{
-		Devices: make([]DeviceMessageV1, 0, len(devices)),
+	response := DeviceListResponseV2{
+		Devices: make([]DeviceMessageV2, 0, len(devices)),
 	}
 
 	for _, device := range devices {
-		response.Devices = append(
-			response.Devices,
-			DeviceMessageV1{
-				DeviceId:   device.LegacyDeviceID,
-				DeviceName: device.DeviceName,
-			},
-		)
+		message, err := s.deviceMessageV2(device, current)
+		if err != nil {
+			problems.AbortWithError(c, err)
+			return
+		}
+		response.Devices = append(response.Devices, message)
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
+func (s *FeederServer) deviceMessageV2(device db.Device, current db.Device) (DeviceMessageV2, error) {
+	deviceId, err := uuid.Parse(device.DeviceID)
+	if err != nil {
+		return DeviceMessageV2{}, err
+	}
+
+	message := DeviceMessageV2{
+		DeviceId:       deviceId,
+		LegacyDeviceId: device.LegacyDeviceID,
+		DeviceName:     device.DeviceName,
+		Platform:       device.Platform,
+		AppVersion:     device.AppVersion,
+		LastSeen:       device.LastSeen.Time.UnixMilli(),
+		Current:        device.DbID == current.DbID,
+		Stale:          s.isStale(device),
+	}
+
+	if device.RegisteredAt.Valid {
+		registeredAt := device.RegisteredAt.Time.UnixMilli()
+		message.RegisteredAt = &registeredAt
+	}
+
+	return message, nil
+}
+
 func (s *FeederServer) handleGETFeedsV1(c *gin.Context) {
 	user := c.MustGet("user").(db.User)
 
 	feeds, err := s.repo.GetLegacyFeeds(c, user)
 	if err != nil {
-		if err == repository.ErrNoFeeds {
+		if errors.Is(err, repository.ErrNoFeeds) {
 			c.Status(http.StatusNoContent)
 			return
 		} else {
-			log.Printf("GetLegacyFeeds error: %s", err.Error())
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Something bad"})
+			problems.AbortWithError(c, err)
 			return
 		}
 	}
 
 	requestEtag := c.GetHeader("If-None-Match")
-	if matchesEtag(requestEtag, feeds.Etag) {
+	matched := matchesEtag(requestEtag, feeds.Etag)
+	if requestEtag != "" {
+		s.metrics.EtagChecked("feeds", matched)
+	}
+	if matched {
 		c.Status(http.StatusNotModified)
 		return
 	}
@@ -272,9 +750,8 @@ func (s *FeederServer) handlePOSTFeedsV1(c *gin.Context) {
 	var currentEtag string
 
 	feeds, err := s.repo.GetLegacyFeeds(c, user)
-	if err != nil && err != repository.ErrNoFeeds {
-		log.Printf("PostLegacyFeeds error: %s", err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Something bad", "err": err.Error()})
+	if err != nil && !errors.Is(err, repository.ErrNoFeeds) {
+		problems.AbortWithError(c, err)
 		return
 	}
 
@@ -282,37 +759,58 @@ func (s *FeederServer) handlePOSTFeedsV1(c *gin.Context) {
 
 	requestEtag := c.GetHeader("If-Match")
 	if !matchesEtag(requestEtag, currentEtag) {
-		log.Printf("Etag mismatch: [%s] != [%s]", requestEtag, currentEtag)
-		c.AbortWithStatus(http.StatusPreconditionFailed)
+		problems.Abort(c, problems.New(http.StatusPreconditionFailed, problems.EtagMismatch, "Etag mismatch").
+			WithDetail(fmt.Sprintf("If-Match %s does not match current %s", requestEtag, currentEtag)))
 		return
 	}
 
+	if s.limits.MaxFeedsBytes > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, s.limits.MaxFeedsBytes+feedsRequestOverheadBytes)
+	}
+
 	var feedsRequest UpdateFeedsRequestV1
-	if err := c.BindJSON(&feedsRequest); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if err := c.ShouldBindJSON(&feedsRequest); err != nil {
+		if isMaxBytesError(err) {
+			abortPayloadTooLarge(c, "feedsBytes", s.limits.MaxFeedsBytes)
+			return
+		}
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Invalid request"))
 		return
 	}
 
 	if feedsRequest.ContentHash == 0 || feedsRequest.Encrypted == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Invalid request"))
+		return
+	}
+
+	if exceeds(int64(len(feedsRequest.Encrypted)), s.limits.MaxFeedsBytes) {
+		abortPayloadTooLarge(c, "feedsBytes", s.limits.MaxFeedsBytes)
 		return
 	}
 
 	newEtag := etagValueForInt64(feedsRequest.ContentHash)
 
-	_, err = s.repo.UpdateLegacyFeeds(
-		c,
-		user,
-		feedsRequest.ContentHash,
-		feedsRequest.Encrypted,
-		newEtag,
-	)
+	err = s.repo.WithTx(c, func(tx repository.Repository) error {
+		_, err := tx.UpdateLegacyFeeds(
+			c,
+			user,
+			feedsRequest.ContentHash,
+			feedsRequest.Encrypted,
+			newEtag,
+		)
+		if err != nil {
+			return err
+		}
 
+		// Larger feeds leave less room for earlier versions
+		_, err = tx.PruneLegacyFeedsVersions(c, user, s.limits.MaxFeedsVersions, s.limits.MaxFeedsBytes)
+		return err
+	})
 	if err != nil {
-		log.Printf("Update feeds failed: %s", err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Something bad"})
+		problems.AbortWithError(c, err)
 		return
 	}
+	s.metrics.FeedsUploaded()
 
 	response := UpdateFeedsResponseV1{
 		ContentHash: feedsRequest.ContentHash,
@@ -333,20 +831,24 @@ func (s *FeederServer) handleGETReadmarkV1(c *gin.Context) {
 		since, err = strconv.ParseInt(sinceRaw, 10, 64)
 
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid value for since-queryParam"})
+			problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidSince, "Invalid value for since-queryParam"))
 			return
 		}
 	}
 
+	// Lets clients know that older read marks have been deleted by the server
+	if user.ReadmarksPrunedBefore.Valid {
+		c.Header(READMARKS_PRUNED_BEFORE_HEADER, strconv.FormatInt(user.ReadmarksPrunedBefore.Time.UnixMilli(), 10))
+	}
+
 	articles, err := s.repo.GetArticlesUpdatedSince(c, user, since)
 
 	if err != nil {
-		if err == repository.ErrNoReadMarks {
+		if errors.Is(err, repository.ErrNoReadMarks) {
 			c.Status(http.StatusNoContent)
 			return
 		} else {
-			log.Printf("Could not fetch articles: %s", err.Error())
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch articles"})
+			problems.AbortWithError(c, err)
 			return
 		}
 	}
@@ -364,6 +866,7 @@ func (s *FeederServer) handleGETReadmarkV1(c *gin.Context) {
 			},
 		)
 	}
+	s.metrics.ReadMarksSent(len(response.ReadMarks))
 
 	c.JSON(http.StatusOK, response)
 }
@@ -373,47 +876,86 @@ func (s *FeederServer) handlePOSTReadmarkV1(c *gin.Context) {
 
 	var sendRequest SendReadMarksRequestV1
 
-	if err := c.BindJSON(&sendRequest); err != nil {
-		log.Println("Bad body")
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Bad body"})
+	if err := c.ShouldBindJSON(&sendRequest); err != nil {
+		slog.DebugContext(c, "Bad body", "error", err)
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Bad body"))
 		return
 	}
 
 	if len(sendRequest.ReadMarks) == 0 {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "No readmarks"})
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.NoReadMarks, "No readmarks"))
+		return
+	}
+
+	if exceeds(int64(len(sendRequest.ReadMarks)), int64(s.limits.MaxReadMarksPerRequest)) {
+		abortPayloadTooLarge(c, "readMarksPerRequest", int64(s.limits.MaxReadMarksPerRequest))
 		return
 	}
 
-	// TODO: Investigate COPY protocol
 	for _, readmark := range sendRequest.ReadMarks {
-		if _, err := s.repo.AddArticle(c, user, readmark.Encrypted); err != nil {
-			log.Printf("Failed to add article: %v", err.Error())
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to store article"})
+		if exceeds(int64(len(readmark.Encrypted)), int64(s.limits.MaxIdentifierLength)) {
+			abortPayloadTooLarge(c, "identifierLength", int64(s.limits.MaxIdentifierLength))
 			return
 		}
 	}
 
+	identifiers := make([]string, 0, len(sendRequest.ReadMarks))
+	for _, readmark := range sendRequest.ReadMarks {
+		identifiers = append(identifiers, readmark.Encrypted)
+	}
+
+	// Read marks are stored first, so that only new ones count against the quota
+	var inserted int64
+	err := s.repo.WithTx(c, func(tx repository.Repository) error {
+		if s.limits.MaxReadMarks > 0 {
+			if err := tx.LockUsers(c, user); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		inserted, err = tx.AddArticles(c, user, identifiers)
+		if err != nil || inserted == 0 || s.limits.MaxReadMarks <= 0 {
+			return err
+		}
+
+		usage, err := tx.GetUsage(c, user)
+		if err != nil {
+			return err
+		}
+		if exceeds(usage.ReadMarks, s.limits.MaxReadMarks) {
+			return &quotaExceededError{quota: "readMarks", limit: s.limits.MaxReadMarks}
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithQuotaError(c, err)
+		return
+	}
+	s.metrics.ReadMarksReceived(int(inserted))
+
 	c.Status(http.StatusNoContent)
 }
 
 func (s *FeederServer) handleCreateV1(c *gin.Context) {
 	var createChainRequest CreateChainRequestV1
 
-	if err := c.BindJSON(&createChainRequest); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Bad body"})
+	if err := c.ShouldBindJSON(&createChainRequest); err != nil {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Bad body"))
 		return
 	}
 
 	if createChainRequest.DeviceName == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Missing deviceName"})
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.MissingDeviceName, "Missing deviceName"))
 		return
 	}
 
 	userDevice, err := s.repo.RegisterNewUser(c, createChainRequest.DeviceName)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Badness"})
+		problems.AbortWithError(c, err)
 		return
 	}
+	s.metrics.ChainCreated()
 
 	response := JoinChainResponseV1{
 		SyncCode: userDevice.User.LegacySyncCode,
@@ -428,26 +970,22 @@ func (s *FeederServer) handleJoinV1(c *gin.Context) {
 
 	var joinChainRequest JoinChainRequestV1
 
-	if err := c.BindJSON(&joinChainRequest); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Bad body"})
+	if err := c.ShouldBindJSON(&joinChainRequest); err != nil {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Bad body"))
 		return
 	}
 
 	if joinChainRequest.DeviceName == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Missing deviceName"})
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.MissingDeviceName, "Missing deviceName"))
 		return
 	}
 
-	device, err := s.repo.AddDeviceToUser(c, user, joinChainRequest.DeviceName)
+	device, err := s.addDeviceWithinQuota(c, user, joinChainRequest.DeviceName)
 	if err != nil {
-		switch err.Error() {
-		case "user not found":
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
-		default:
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Badness"})
-		}
+		abortWithQuotaError(c, err)
 		return
 	}
+	s.metrics.DeviceJoined()
 
 	response := JoinChainResponseV1{
 		SyncCode: user.LegacySyncCode,
@@ -460,33 +998,32 @@ func (s *FeederServer) handleJoinV1(c *gin.Context) {
 func (s *FeederServer) handleCreateV2(c *gin.Context) {
 	var createChainRequest CreateChainRequestV2
 
-	if err := c.BindJSON(&createChainRequest); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Bad body"})
+	if err := c.ShouldBindJSON(&createChainRequest); err != nil {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Bad body"))
 		return
 	}
 
 	if createChainRequest.DeviceName == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Missing deviceName"})
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.MissingDeviceName, "Missing deviceName"))
 		return
 	}
 
 	userDevice, err := s.repo.RegisterNewUser(c, createChainRequest.DeviceName)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Badness"})
+		problems.AbortWithError(c, err)
 		return
 	}
+	s.metrics.ChainCreated()
 
 	userId, err := uuid.Parse(userDevice.User.UserID)
 	if err != nil {
-		log.Printf("Could not parse UUID: %s", userDevice.User.UserID)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Badness"})
+		problems.AbortWithError(c, err)
 		return
 	}
 
 	deviceId, err := uuid.Parse(userDevice.Device.DeviceID)
 	if err != nil {
-		log.Printf("Could not parse UUID: %s", userDevice.Device.DeviceID)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Badness"})
+		problems.AbortWithError(c, err)
 		return
 	}
 
@@ -504,38 +1041,32 @@ func (s *FeederServer) handleJoinV2(c *gin.Context) {
 
 	var joinChainRequest JoinChainRequestV2
 
-	if err := c.BindJSON(&joinChainRequest); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Bad body"})
+	if err := c.ShouldBindJSON(&joinChainRequest); err != nil {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Bad body"))
 		return
 	}
 
 	if joinChainRequest.DeviceName == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Missing deviceName"})
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.MissingDeviceName, "Missing deviceName"))
 		return
 	}
 
-	device, err := s.repo.AddDeviceToUser(c, user, joinChainRequest.DeviceName)
+	device, err := s.addDeviceWithinQuota(c, user, joinChainRequest.DeviceName)
 	if err != nil {
-		switch err.Error() {
-		case "No such user":
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No such user"})
-		default:
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Badness"})
-		}
+		abortWithQuotaError(c, err)
 		return
 	}
+	s.metrics.DeviceJoined()
 
 	userId, err := uuid.Parse(user.UserID)
 	if err != nil {
-		log.Printf("Could not parse UUID: %s", user.UserID)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Badness"})
+		problems.AbortWithError(c, err)
 		return
 	}
 
 	deviceId, err := uuid.Parse(device.DeviceID)
 	if err != nil {
-		log.Printf("Could not parse UUID: %s", device.DeviceID)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Badness"})
+		problems.AbortWithError(c, err)
 		return
 	}
 
@@ -547,3 +1078,162 @@ func (s *FeederServer) handleJoinV2(c *gin.Context) {
 
 	c.JSON(http.StatusCreated, response)
 }
+
+// Adds the device unless the chain already has as many devices as allowed
+func (s *FeederServer) addDeviceWithinQuota(c *gin.Context, user db.User, deviceName string) (db.Device, error) {
+	var device db.Device
+	err := s.repo.WithTx(c, func(tx repository.Repository) error {
+		if s.limits.MaxDevices > 0 {
+			// Concurrent joins would otherwise all see room for one more
+			if err := tx.LockUsers(c, user); err != nil {
+				return err
+			}
+
+			usage, err := tx.GetUsage(c, user)
+			if err != nil {
+				return err
+			}
+			if exceeds(usage.Devices+1, s.limits.MaxDevices) {
+				return &quotaExceededError{quota: "devices", limit: s.limits.MaxDevices}
+			}
+		}
+
+		var err error
+		device, err = tx.AddDeviceToUser(c, user, deviceName)
+		return err
+	})
+	return device, err
+}
+
+func (s *FeederServer) handleUsageV2(c *gin.Context) {
+	user := c.MustGet("user").(db.User)
+
+	usage, err := s.repo.GetUsage(c, user)
+	if err != nil {
+		problems.AbortWithError(c, err)
+		return
+	}
+
+	response := UsageResponseV2{
+		ReadMarks: QuotaV2{
+			Used:  usage.ReadMarks,
+			Limit: s.limits.MaxReadMarks,
+		},
+		FeedsBytes: QuotaV2{
+			Used:  usage.FeedsBytes,
+			Limit: s.limits.MaxFeedsBytes,
+		},
+		Devices: QuotaV2{
+			Used:  usage.Devices,
+			Limit: s.limits.MaxDevices,
+		},
+		MaxReadMarksPerRequest: s.limits.MaxReadMarksPerRequest,
+		MaxIdentifierLength:    s.limits.MaxIdentifierLength,
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Sent on the events stream when the device has been removed from the chain
+const deviceRemovedEvent = "removed"
+
+// Returns true if the device no longer exists
+func (s *FeederServer) wasRemoved(c *gin.Context, user db.User, device db.Device) bool {
+	_, err := s.repo.GetDeviceWithLegacyId(c, user, device.LegacyDeviceID)
+	return errors.Is(err, repository.ErrNoSuchDevice)
+}
+
+// Keeps idle connections from being closed by proxies
+const eventsKeepAliveInterval = 30 * time.Second
+
+func (s *FeederServer) handleEventsV2(c *gin.Context) {
+	user := c.MustGet("user").(db.User)
+	device := c.MustGet("device").(db.Device)
+
+	subscription := s.broker.Subscribe(user.DbID, device.DbID)
+	defer subscription.Close()
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Disables response buffering in nginx
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return false
+			}
+			if event.Kind == events.ChainMerged {
+				c.SSEvent(string(event.Kind), EventMessageV2{Type: string(event.Kind)})
+				return false
+			}
+			if event.Kind == events.DevicesChanged && s.wasRemoved(c, user, device) {
+				c.SSEvent(deviceRemovedEvent, EventMessageV2{Type: deviceRemovedEvent})
+				return false
+			}
+			c.SSEvent(string(event.Kind), EventMessageV2{Type: string(event.Kind)})
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		}
+	})
+}
+
+const maxPushEndpointLength = 2048
+
+func (s *FeederServer) handlePUTPushV2(c *gin.Context) {
+	device := c.MustGet("device").(db.Device)
+
+	var pushRequest PushEndpointRequestV2
+	if err := c.ShouldBindJSON(&pushRequest); err != nil {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidBody, "Bad body"))
+		return
+	}
+
+	if !s.isValidPushEndpoint(pushRequest.Endpoint) {
+		problems.Abort(c, problems.New(http.StatusBadRequest, problems.InvalidPushEndpoint, "Invalid endpoint"))
+		return
+	}
+
+	if err := s.repo.SetPushEndpoint(c, device, pushRequest.Endpoint); err != nil {
+		problems.AbortWithError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *FeederServer) handleDELETEPushV2(c *gin.Context) {
+	device := c.MustGet("device").(db.Device)
+
+	if err := s.repo.SetPushEndpoint(c, device, ""); err != nil {
+		problems.AbortWithError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Only absolute https URLs are accepted since the server will POST to them
+func (s *FeederServer) isValidPushEndpoint(endpoint string) bool {
+	if endpoint == "" || len(endpoint) > maxPushEndpointLength {
+		return false
+	}
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+
+	// Names resolving to private addresses are refused by the pusher when dialling
+	return parsed.Scheme == "https" && push.IsAllowedHost(parsed.Hostname(), s.pushAllowedHosts)
+}
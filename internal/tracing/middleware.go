@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Route of requests which matched no route
+const unmatchedRoute = "unmatched"
+
+// Middleware starts a span of every request, covering the rest of the middleware chain and the handler.
+// It must come first, so that every later middleware, and the repository, sees the span.
+func Middleware() gin.HandlerFunc {
+	tracer := otel.Tracer(instrumentationName)
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		// Named after the route, not the path, which may contain ids
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// Handler wraps a middleware or handler in a span of its own, a child of the request's span.
+// h must not call c.Next(), or the span would cover the handlers after it as well.
+func Handler(name string, h gin.HandlerFunc) gin.HandlerFunc {
+	tracer := otel.Tracer(instrumentationName)
+	return func(c *gin.Context) {
+		parent := trace.SpanFromContext(c.Request.Context())
+		ctx, span := tracer.Start(c.Request.Context(), name,
+			trace.WithAttributes(attribute.String("code.function", name)),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		h(c)
+		// Keeps what h put in the context, but makes later handlers children of the request's span again
+		c.Request = c.Request.WithContext(trace.ContextWithSpan(c.Request.Context(), parent))
+
+		if status := c.Writer.Status(); status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Name of the service in exported spans, unless OTEL_SERVICE_NAME is set
+const ServiceName = "feeder-sync"
+
+const instrumentationName = "github.com/spacecowboy/feeder-sync"
+
+// Options of the exporter. Nothing is exported when Endpoint is empty.
+type Options struct {
+	// Base URL of an OTLP/HTTP collector, like http://localhost:4318
+	Endpoint string
+	// Fraction of traces started here which are exported. Traces started by a client follow its decision.
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider and propagator. The returned function
+// exports pending spans, and must be called before exiting.
+func Setup(ctx context.Context, options Options) (func(context.Context) error, error) {
+	// Trace ids sent by clients are logged even when nothing is exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if options.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// Headers, like credentials, are read from OTEL_EXPORTER_OTLP_HEADERS
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(options.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	// Later attributes win, so the environment can override the service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,195 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Records spans in memory, through the global provider like in production
+func record(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+	return recorder
+}
+
+func attributeOf(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestMiddlewareContinuesClientTraceAndNamesSpanByRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := record(t)
+
+	var handlerSpan trace.SpanContext
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/api/v1/devices/:id", func(c *gin.Context) {
+		handlerSpan = trace.SpanContextFromContext(c.Request.Context())
+		c.Status(http.StatusInternalServerError)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/devices/1", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans; want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /api/v1/devices/:id" {
+		t.Errorf("name = %q", span.Name())
+	}
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id = %s; want the client's", span.SpanContext().TraceID())
+	}
+	if handlerSpan.SpanID() != span.SpanContext().SpanID() {
+		t.Error("handler did not see the span")
+	}
+	if status := attributeOf(span, "http.response.status_code").AsInt64(); status != http.StatusInternalServerError {
+		t.Errorf("status = %d", status)
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("span status = %v; want error", span.Status().Code)
+	}
+}
+
+type markKey struct{}
+
+func TestHandlerSpansAreChildrenOfTheRequestSpan(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := record(t)
+
+	var marked any
+	router := gin.New()
+	router.Use(Middleware())
+	auth := Handler("auth", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), markKey{}, "auth"))
+	})
+	router.GET("/api/v1/devices", auth, Handler("devices", func(c *gin.Context) {
+		marked = c.Request.Context().Value(markKey{})
+		c.Status(http.StatusOK)
+	}))
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/devices", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans; want 3", len(spans))
+	}
+	// Ended in order, the request span last
+	request := spans[2]
+	for i, name := range []string{"auth", "devices"} {
+		if spans[i].Name() != name {
+			t.Errorf("span %d is %q; want %q", i, spans[i].Name(), name)
+		}
+		if spans[i].Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of the request span", name)
+		}
+	}
+	if marked != "auth" {
+		t.Errorf("handler saw %v; want the value set by the middleware", marked)
+	}
+}
+
+func TestQueryTracerNamesSpansAndChains(t *testing.T) {
+	recorder := record(t)
+	next := &countingTracer{}
+	tracer := QueryTracer(next)
+
+	ctx := tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "-- name: GetUser :one\nSELECT 1"})
+	tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{CommandTag: pgconn.NewCommandTag("SELECT 1")})
+
+	ctx = tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "-- name: GetDevice :one\nSELECT 1"})
+	tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: pgx.ErrNoRows})
+
+	ctx = tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+	tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: errors.New("boom")})
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans; want 3", len(spans))
+	}
+	for i, expected := range []struct {
+		name string
+		code codes.Code
+	}{
+		{"GetUser", codes.Unset},
+		{"GetDevice", codes.Unset},
+		{"other", codes.Error},
+	} {
+		if spans[i].Name() != expected.name {
+			t.Errorf("span %d name = %q; want %q", i, spans[i].Name(), expected.name)
+		}
+		if spans[i].Status().Code != expected.code {
+			t.Errorf("span %s status = %v; want %v", expected.name, spans[i].Status().Code, expected.code)
+		}
+	}
+	if next.started != 3 || next.ended != 3 {
+		t.Errorf("next tracer saw %d starts and %d ends; want 3 of each", next.started, next.ended)
+	}
+}
+
+func TestLogHandlerAddsTraceIds(t *testing.T) {
+	record(t)
+	var out bytes.Buffer
+	logger := slog.New(LogHandler(slog.NewTextHandler(&out, nil)))
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "test")
+	logger.InfoContext(ctx, "traced")
+	span.End()
+	logger.InfoContext(context.Background(), "untraced")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines; want 2", len(lines))
+	}
+	if !strings.Contains(lines[0], "trace_id="+span.SpanContext().TraceID().String()) {
+		t.Errorf("traced line has no trace id: %s", lines[0])
+	}
+	if strings.Contains(lines[1], "trace_id") {
+		t.Errorf("untraced line has a trace id: %s", lines[1])
+	}
+}
+
+type countingTracer struct {
+	started int
+	ended   int
+}
+
+func (c *countingTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	c.started++
+	return ctx
+}
+
+func (c *countingTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {
+	c.ended++
+}
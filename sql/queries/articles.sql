@@ -1,7 +1,7 @@
--- name: InsertArticle :one
+-- name: InsertArticles :execrows
 INSERT INTO articles (user_db_id, identifier, read_time, updated_at)
-VALUES ($1, $2, $3, $4)
-RETURNING *;
+SELECT @user_db_id::bigint, unnest(@identifiers::text[]), @read_time::timestamptz, @read_time::timestamptz
+ON CONFLICT (user_db_id, identifier) DO NOTHING;
 
 -- name: GetAllArticles :many
 SELECT
@@ -15,3 +15,34 @@ FROM articles
 WHERE user_db_id = $1 AND updated_at > $2
 ORDER BY read_time DESC
 LIMIT 1000;
+
+-- name: PruneArticlesReadBefore :one
+WITH deleted AS (
+    DELETE FROM articles
+    WHERE db_id IN (
+        SELECT db_id
+        FROM articles
+        WHERE read_time < $1
+        ORDER BY read_time
+        LIMIT $2
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING user_db_id
+), marked AS (
+    UPDATE users
+    SET readmarks_pruned_before = $1
+    WHERE db_id IN (SELECT DISTINCT user_db_id FROM deleted)
+    AND (readmarks_pruned_before IS NULL OR readmarks_pruned_before < $1)
+)
+SELECT count(*) FROM deleted;
+
+-- name: MoveArticles :execrows
+WITH moved AS (
+    DELETE FROM articles
+    WHERE user_db_id = @source_user_db_id
+    RETURNING identifier, read_time
+)
+INSERT INTO articles (user_db_id, identifier, read_time, updated_at)
+SELECT @target_user_db_id::bigint, identifier, read_time, @updated_at::timestamptz
+FROM moved
+ON CONFLICT (user_db_id, identifier) DO NOTHING;
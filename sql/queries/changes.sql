@@ -0,0 +1,10 @@
+-- name: NotifyChange :exec
+SELECT pg_notify(
+    'feeder_sync_changes',
+    json_build_object(
+        'user', @user_db_id::bigint,
+        'kind', @kind::text,
+        'device', @device_db_id::bigint,
+        'seq', nextval('change_seq')
+    )::text
+);
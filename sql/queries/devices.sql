@@ -24,12 +24,23 @@ SELECT
 FROM devices
 WHERE user_db_id = $1;
 
--- name: GetLegacyDevicesEtag :one
+-- name: GetDevicesEtag :one
 SELECT
-    sha256(convert_to(string_agg(device_name, '' ORDER BY device_name), 'UTF8'))
+    sha256(convert_to(coalesce(string_agg(
+        concat_ws(
+            E'\x1f',
+            legacy_device_id::text,
+            device_id,
+            device_name,
+            platform,
+            app_version,
+            coalesce((extract(epoch FROM registered_at) * 1000)::bigint::text, ''),
+            (last_seen < @stale_before)::text
+        ),
+        E'\x1e' ORDER BY legacy_device_id
+    ), ''), 'UTF8'))::bytea AS etag
 FROM devices
-WHERE user_db_id = $1
-GROUP BY user_db_id;
+WHERE user_db_id = @user_db_id;
 
 -- name: GetLegacyDevice :one
 SELECT
@@ -38,7 +49,79 @@ FROM devices
 WHERE user_db_id = $1 AND legacy_device_id = $2
 LIMIT 1;
 
--- name: UpdateLastSeenForDevice :exec
+-- name: UpdateLastSeenForDevices :exec
 UPDATE devices
-SET last_seen = $1
+SET last_seen = seen.last_seen
+FROM unnest(@db_ids::bigint[], @last_seen::timestamptz[]) AS seen(db_id, last_seen)
+WHERE devices.db_id = seen.db_id
+AND devices.last_seen < seen.last_seen;
+
+-- name: DeleteDevicesNotSeenSince :many
+DELETE FROM devices
+WHERE db_id IN (
+    SELECT db_id
+    FROM devices
+    WHERE last_seen < $1
+    ORDER BY last_seen
+    LIMIT $2
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING user_db_id;
+
+-- name: UpdatePushEndpoint :exec
+UPDATE devices
+SET push_endpoint = $1
 WHERE db_id = $2;
+
+-- name: GetPushEndpoints :many
+SELECT
+    db_id,
+    push_endpoint::text AS push_endpoint
+FROM devices
+WHERE user_db_id = $1 AND db_id <> $2 AND push_endpoint IS NOT NULL;
+
+-- name: ClearPushEndpoint :exec
+UPDATE devices
+SET push_endpoint = NULL
+WHERE db_id = $1 AND push_endpoint = $2;
+
+-- name: UpdateDevice :one
+UPDATE devices
+SET
+    device_name = coalesce(sqlc.narg(device_name), device_name),
+    platform = coalesce(sqlc.narg(platform), platform),
+    app_version = coalesce(sqlc.narg(app_version), app_version)
+WHERE user_db_id = @user_db_id AND device_id = @device_id
+RETURNING *;
+
+-- name: MoveDevices :execrows
+UPDATE devices
+SET user_db_id = @target_user_db_id
+WHERE user_db_id = @source_user_db_id;
+
+-- name: AuthenticateDevice :one
+WITH found_user AS (
+    SELECT *
+    FROM users
+    WHERE users.user_id = sqlc.narg(user_id)
+    OR users.db_id = (SELECT user_db_id FROM user_id_aliases WHERE user_id_aliases.user_id = sqlc.narg(user_id))
+    OR users.legacy_sync_code = sqlc.narg(sync_code)
+    OR users.db_id = (SELECT user_db_id FROM sync_code_aliases WHERE sync_code_aliases.legacy_sync_code = sqlc.narg(sync_code))
+    LIMIT 1
+)
+SELECT
+    found_user.db_id,
+    found_user.user_id,
+    found_user.legacy_sync_code,
+    found_user.readmarks_pruned_before,
+    devices.db_id AS device_db_id,
+    devices.device_id,
+    devices.legacy_device_id,
+    devices.device_name,
+    devices.last_seen,
+    devices.push_endpoint,
+    devices.platform,
+    devices.app_version,
+    devices.registered_at
+FROM found_user
+LEFT JOIN devices ON devices.user_db_id = found_user.db_id AND devices.legacy_device_id = @legacy_device_id;
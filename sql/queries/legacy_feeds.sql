@@ -24,3 +24,50 @@ SET content_hash = excluded.content_hash,
 content = excluded.content,
 etag = excluded.etag
 RETURNING db_id;
+
+-- name: ArchiveLegacyFeeds :execrows
+INSERT INTO legacy_feeds_versions (user_db_id, content_hash, content, etag)
+SELECT @target_user_db_id::bigint, content_hash, content, etag
+FROM legacy_feeds
+WHERE user_db_id = @target_user_db_id OR user_db_id = @source_user_db_id
+ORDER BY user_db_id = @target_user_db_id;
+
+-- name: MoveLegacyFeedsVersions :exec
+UPDATE legacy_feeds_versions
+SET user_db_id = @target_user_db_id
+WHERE user_db_id = @source_user_db_id;
+
+-- name: AdoptLegacyFeeds :execrows
+UPDATE legacy_feeds
+SET user_db_id = @target_user_db_id
+WHERE user_db_id = @source_user_db_id
+AND NOT EXISTS (SELECT 1 FROM legacy_feeds WHERE user_db_id = @target_user_db_id);
+
+-- name: GetLegacyFeedsVersions :many
+SELECT
+    *
+FROM legacy_feeds_versions
+WHERE user_db_id = $1
+ORDER BY created_at DESC, db_id DESC;
+
+-- name: PruneLegacyFeedsVersions :execrows
+WITH ranked AS (
+    SELECT
+        db_id,
+        row_number() OVER newest_first AS newness,
+        sum(octet_length(content)) OVER newest_first AS cumulative_bytes
+    FROM legacy_feeds_versions
+    WHERE user_db_id = @user_db_id
+    WINDOW newest_first AS (ORDER BY created_at DESC, db_id DESC)
+), current_feeds AS (
+    SELECT coalesce(sum(octet_length(content)), 0) AS bytes
+    FROM legacy_feeds
+    WHERE user_db_id = @user_db_id
+)
+DELETE FROM legacy_feeds_versions
+WHERE db_id IN (
+    SELECT ranked.db_id
+    FROM ranked, current_feeds
+    WHERE (@max_versions::int > 0 AND ranked.newness > @max_versions::int)
+    OR (@max_bytes::bigint > 0 AND ranked.cumulative_bytes + current_feeds.bytes > @max_bytes::bigint)
+);
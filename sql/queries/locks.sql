@@ -0,0 +1,8 @@
+-- name: TryAdvisoryLock :one
+SELECT pg_try_advisory_lock(@lock_id::bigint);
+
+-- name: AdvisoryUnlock :one
+SELECT pg_advisory_unlock(@lock_id::bigint);
+
+-- name: AdvisoryLock :exec
+SELECT pg_advisory_lock(@lock_id::bigint);
@@ -16,7 +16,76 @@ FROM users;
 SELECT db_id FROM users WHERE legacy_sync_code = $1 LIMIT 1;
 
 -- name: GetUserBySyncCode :one
-SELECT * FROM users WHERE legacy_sync_code = $1 LIMIT 1;
+SELECT * FROM users
+WHERE legacy_sync_code = $1
+OR db_id = (SELECT user_db_id FROM sync_code_aliases WHERE sync_code_aliases.legacy_sync_code = $1)
+LIMIT 1;
 
 -- name: GetUserByUserId :one
-SELECT * FROM users WHERE user_id = $1 LIMIT 1;
+SELECT * FROM users
+WHERE user_id = $1
+OR db_id = (SELECT user_db_id FROM user_id_aliases WHERE user_id_aliases.user_id = $1)
+LIMIT 1;
+
+-- name: GetUserUsage :one
+SELECT
+    (SELECT count(*) FROM articles WHERE articles.user_db_id = $1)::bigint AS read_marks,
+    (SELECT count(*) FROM devices WHERE devices.user_db_id = $1)::bigint AS devices,
+    (
+        (SELECT coalesce(sum(octet_length(content)), 0) FROM legacy_feeds WHERE legacy_feeds.user_db_id = $1)
+        + (SELECT coalesce(sum(octet_length(content)), 0) FROM legacy_feeds_versions WHERE legacy_feeds_versions.user_db_id = $1)
+    )::bigint AS feeds_bytes;
+
+-- name: GetUsersWithoutDevices :many
+SELECT db_id
+FROM users
+WHERE NOT EXISTS (SELECT 1 FROM devices WHERE devices.user_db_id = users.db_id)
+LIMIT $1;
+
+-- name: DeleteUsersWithoutDevices :execrows
+WITH orphans AS (
+    SELECT db_id
+    FROM users
+    WHERE db_id = ANY(@user_db_ids::bigint[])
+    AND NOT EXISTS (SELECT 1 FROM devices WHERE devices.user_db_id = users.db_id)
+), deleted_articles AS (
+    DELETE FROM articles WHERE user_db_id IN (SELECT db_id FROM orphans)
+), deleted_feeds AS (
+    DELETE FROM legacy_feeds WHERE user_db_id IN (SELECT db_id FROM orphans)
+), deleted_feeds_versions AS (
+    DELETE FROM legacy_feeds_versions WHERE user_db_id IN (SELECT db_id FROM orphans)
+), deleted_aliases AS (
+    DELETE FROM sync_code_aliases WHERE user_db_id IN (SELECT db_id FROM orphans)
+), deleted_user_id_aliases AS (
+    DELETE FROM user_id_aliases WHERE user_db_id IN (SELECT db_id FROM orphans)
+)
+DELETE FROM users WHERE db_id IN (SELECT db_id FROM orphans);
+
+-- name: LockUsers :many
+SELECT db_id
+FROM users
+WHERE db_id = ANY(@user_db_ids::bigint[])
+ORDER BY db_id
+FOR UPDATE;
+
+-- name: MergeSyncCodeAliases :exec
+WITH moved AS (
+    UPDATE sync_code_aliases
+    SET user_db_id = @target_user_db_id
+    WHERE user_db_id = @source_user_db_id
+)
+INSERT INTO sync_code_aliases (legacy_sync_code, user_db_id)
+SELECT legacy_sync_code, @target_user_db_id::bigint
+FROM users
+WHERE db_id = @source_user_db_id;
+
+-- name: MergeUserIdAliases :exec
+WITH moved AS (
+    UPDATE user_id_aliases
+    SET user_db_id = @target_user_db_id
+    WHERE user_db_id = @source_user_db_id
+)
+INSERT INTO user_id_aliases (user_id, user_db_id)
+SELECT user_id, @target_user_db_id::bigint
+FROM users
+WHERE db_id = @source_user_db_id;
@@ -1,2 +1,2 @@
--- SQLite doesn't support drop column
--- Won't be downgrading anyway...
+alter table articles
+  drop column if exists updated_at;
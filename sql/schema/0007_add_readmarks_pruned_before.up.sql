@@ -0,0 +1,3 @@
+-- Read marks older than this have been deleted by the retention job
+alter table users
+  add column readmarks_pruned_before timestamptz;
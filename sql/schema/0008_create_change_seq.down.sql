@@ -0,0 +1 @@
+drop sequence if exists change_seq;
@@ -0,0 +1,2 @@
+-- Orders change notifications sent with NOTIFY
+create sequence change_seq;
@@ -0,0 +1,2 @@
+alter table devices
+  drop column if exists push_endpoint;
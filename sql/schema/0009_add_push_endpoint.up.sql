@@ -0,0 +1,3 @@
+-- UnifiedPush endpoint which the device wants to be woken up on
+alter table devices
+  add column push_endpoint text;
@@ -0,0 +1,5 @@
+alter table devices
+  drop column if exists app_version;
+
+alter table devices
+  drop column if exists platform;
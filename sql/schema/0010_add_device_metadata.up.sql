@@ -0,0 +1,6 @@
+-- As reported by the app
+alter table devices
+  add column platform text not null default '';
+
+alter table devices
+  add column app_version text not null default '';
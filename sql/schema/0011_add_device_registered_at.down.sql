@@ -0,0 +1,2 @@
+alter table devices
+  drop column if exists registered_at;
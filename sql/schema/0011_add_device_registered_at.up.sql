@@ -0,0 +1,6 @@
+-- Unknown for devices registered before this migration
+alter table devices
+  add column registered_at timestamptz;
+
+alter table devices
+  alter column registered_at set default now();
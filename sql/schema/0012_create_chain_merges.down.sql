@@ -0,0 +1,2 @@
+drop table if exists sync_code_aliases;
+drop table if exists legacy_feeds_versions;
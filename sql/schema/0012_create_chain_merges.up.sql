@@ -0,0 +1,24 @@
+-- Previous versions of the feeds, kept when two chains are merged
+create table legacy_feeds_versions (
+  db_id bigserial primary key,
+  content_hash bigint not null,
+  content text not null,
+  etag text not null,
+  created_at timestamptz not null default now(),
+
+  user_db_id bigint not null references users(db_id)
+);
+
+create index idx_legacy_feeds_versions_user_db
+  on legacy_feeds_versions(user_db_id);
+
+-- Sync codes of chains which were merged into another chain.
+-- Devices of the merged chain keep using their old sync code.
+create table sync_code_aliases (
+  legacy_sync_code text primary key,
+
+  user_db_id bigint not null references users(db_id)
+);
+
+create index idx_sync_code_aliases_user_db
+  on sync_code_aliases(user_db_id);
@@ -0,0 +1,10 @@
+-- User ids of chains which were merged into another chain.
+-- Devices of the merged chain keep using their old user id.
+create table user_id_aliases (
+  user_id text primary key,
+
+  user_db_id bigint not null references users(db_id)
+);
+
+create index idx_user_id_aliases_user_db
+  on user_id_aliases(user_db_id);
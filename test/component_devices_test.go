@@ -0,0 +1,66 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/spacecowboy/feeder-sync/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func patchDevice(t *testing.T, baseUrl string, device testDevice, deviceUuid string, body string) (server.DeviceMessageV2, string) {
+	response := deviceRequest(t, device, http.MethodPatch, fmt.Sprintf("%s/api/v2/devices/%s", baseUrl, deviceUuid), body)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var message server.DeviceMessageV2
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&message))
+	return message, response.Header.Get("ETag")
+}
+
+func TestPatchDeviceUpdatesNameAndMetadata(t *testing.T) {
+	baseUrl := fmt.Sprintf("http://%s", listenAddress)
+
+	alice := newDevice(t, baseUrl, "", "alice")
+
+	// Joining through v2 is how a device learns its uuid
+	response := deviceRequest(t, testDevice{SyncCode: alice.SyncCode}, http.MethodPost, baseUrl+"/api/v2/join", `{"deviceName": "bob"}`)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	var bob server.UserDeviceResponseV2
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&bob))
+
+	listResponse := deviceRequest(t, alice, http.MethodGet, baseUrl+"/api/v1/devices", "")
+	listResponse.Body.Close()
+	etagBefore := listResponse.Header.Get("ETag")
+	require.NotEmpty(t, etagBefore)
+
+	message, etag := patchDevice(t, baseUrl, alice, bob.DeviceId.String(), `{"deviceName": "carol", "platform": "android", "appVersion": "2.7.0"}`)
+	require.Equal(t, bob.DeviceId, message.DeviceId)
+	require.Equal(t, "carol", message.DeviceName)
+	require.Equal(t, "android", message.Platform)
+	require.Equal(t, "2.7.0", message.AppVersion)
+	require.False(t, message.Current)
+	require.NotEmpty(t, etag)
+	require.NotEqual(t, etagBefore, etag)
+
+	// Omitted fields are left unchanged
+	message, _ = patchDevice(t, baseUrl, alice, bob.DeviceId.String(), `{"appVersion": "2.8.0"}`)
+	require.Equal(t, "carol", message.DeviceName)
+	require.Equal(t, "android", message.Platform)
+	require.Equal(t, "2.8.0", message.AppVersion)
+
+	// The old list is stale, and the new one shows the name
+	request := newDeviceRequest(t, alice, http.MethodGet, baseUrl+"/api/v1/devices", "")
+	request.Header.Set("If-None-Match", etagBefore)
+	listResponse, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer listResponse.Body.Close()
+	require.Equal(t, http.StatusOK, listResponse.StatusCode)
+	body, err := io.ReadAll(listResponse.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `"deviceName":"carol"`)
+}
@@ -0,0 +1,195 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spacecowboy/feeder-sync/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+const basicAuth = "Basic ZmVlZGVyX3VzZXI6ZmVlZGVyX3NlY3JldF8xMjM0"
+
+// Time allowed for an event to arrive, including a trip through Postgres
+const eventTimeout = 10 * time.Second
+
+type testDevice struct {
+	SyncCode string `json:"syncCode"`
+	DeviceId int64  `json:"deviceId"`
+}
+
+func deviceRequest(t *testing.T, device testDevice, method string, url string, body string) *http.Response {
+	response, err := http.DefaultClient.Do(newDeviceRequest(t, device, method, url, body))
+	require.NoError(t, err)
+	return response
+}
+
+func newDeviceRequest(t *testing.T, device testDevice, method string, url string, body string) *http.Request {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", basicAuth)
+	if device.SyncCode != "" {
+		request.Header.Set("X-FEEDER-ID", device.SyncCode)
+	}
+	if device.DeviceId != 0 {
+		request.Header.Set("X-FEEDER-DEVICE-ID", strconv.FormatInt(device.DeviceId, 10))
+	}
+	return request
+}
+
+// Creates a chain if syncCode is empty, and joins it otherwise
+func newDevice(t *testing.T, baseUrl string, syncCode string, name string) testDevice {
+	path := "/api/v1/create"
+	if syncCode != "" {
+		path = "/api/v1/join"
+	}
+	response := deviceRequest(t, testDevice{SyncCode: syncCode}, http.MethodPost, baseUrl+path, fmt.Sprintf(`{"deviceName": %q}`, name))
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	var device testDevice
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&device))
+	return device
+}
+
+func postReadMark(t *testing.T, baseUrl string, device testDevice, identifier string) {
+	response := deviceRequest(t, device, http.MethodPost, baseUrl+"/api/v1/ereadmark", fmt.Sprintf(`{"items": [{"encrypted": %q}]}`, identifier))
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNoContent, response.StatusCode)
+}
+
+// Opens the event stream of the device and returns the names of the events as they arrive.
+// The channel is closed when the server ends the stream.
+func openEvents(t *testing.T, baseUrl string, device testDevice) <-chan string {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseUrl+"/api/v2/events", nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", basicAuth)
+	request.Header.Set("X-FEEDER-ID", device.SyncCode)
+	request.Header.Set("X-FEEDER-DEVICE-ID", strconv.FormatInt(device.DeviceId, 10))
+
+	// Returns once the headers are flushed, which happens after subscribing
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	names := make(chan string, 16)
+	go func() {
+		defer close(names)
+		defer response.Body.Close()
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if name, ok := strings.CutPrefix(scanner.Text(), "event:"); ok {
+				names <- strings.TrimSpace(name)
+			}
+		}
+	}()
+	return names
+}
+
+// Waits for the named event, skipping others. Calls trigger until it arrives,
+// since a change made before another instance listens is not delivered.
+func awaitEvent(t *testing.T, names <-chan string, expected string, trigger func()) {
+	deadline := time.After(eventTimeout)
+	retry := time.NewTicker(time.Second)
+	defer retry.Stop()
+
+	trigger()
+	for {
+		select {
+		case name, ok := <-names:
+			require.True(t, ok, "stream ended before %q", expected)
+			if name == expected {
+				return
+			}
+		case <-retry.C:
+			trigger()
+		case <-deadline:
+			t.Fatalf("no %q event within %s", expected, eventTimeout)
+		}
+	}
+}
+
+// A second server on the same database stands in for another instance
+func startOtherInstance(t *testing.T, options ...server.ServerOption) string {
+	other, err := server.NewServerWithPostgres(connString, options...)
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(other)
+	t.Cleanup(func() {
+		httpServer.Close()
+		_ = other.Close()
+	})
+	return httpServer.URL
+}
+
+func TestChangeReachesSubscriberOnOtherInstance(t *testing.T) {
+	baseUrl := fmt.Sprintf("http://%s", listenAddress)
+	otherUrl := startOtherInstance(t)
+
+	subscriber := newDevice(t, baseUrl, "", "subscriber")
+	writer := newDevice(t, baseUrl, subscriber.SyncCode, "writer")
+
+	names := openEvents(t, otherUrl, subscriber)
+
+	count := 0
+	awaitEvent(t, names, "readmarks", func() {
+		count++
+		postReadMark(t, baseUrl, writer, fmt.Sprintf("cross-instance-%d", count))
+	})
+}
+
+func TestEventsStreamChangesOfOtherDevices(t *testing.T) {
+	baseUrl := fmt.Sprintf("http://%s", listenAddress)
+
+	subscriber := newDevice(t, baseUrl, "", "subscriber")
+	writer := newDevice(t, baseUrl, subscriber.SyncCode, "writer")
+
+	names := openEvents(t, baseUrl, subscriber)
+
+	count := 0
+	awaitEvent(t, names, "readmarks", func() {
+		count++
+		postReadMark(t, baseUrl, writer, fmt.Sprintf("same-instance-%d", count))
+	})
+}
+
+func TestEventsStreamEndsWhenDeviceIsRemoved(t *testing.T) {
+	baseUrl := fmt.Sprintf("http://%s", listenAddress)
+
+	subscriber := newDevice(t, baseUrl, "", "subscriber")
+	remover := newDevice(t, baseUrl, subscriber.SyncCode, "remover")
+
+	names := openEvents(t, baseUrl, subscriber)
+
+	removals := 0
+	awaitEvent(t, names, "removed", func() {
+		removals++
+		response := deviceRequest(t, remover, http.MethodDelete, fmt.Sprintf("%s/api/v1/devices/%d", baseUrl, subscriber.DeviceId), "")
+		defer response.Body.Close()
+		// A retry finds the device already gone
+		if removals == 1 {
+			require.Equal(t, http.StatusOK, response.StatusCode)
+		} else {
+			require.Equal(t, http.StatusNotFound, response.StatusCode)
+		}
+	})
+
+	select {
+	case name, ok := <-names:
+		require.False(t, ok, "got %q after the device was removed", name)
+	case <-time.After(eventTimeout):
+		t.Fatal("stream was not ended")
+	}
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/spacecowboy/feeder-sync/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func postFeeds(t *testing.T, baseUrl string, device testDevice, contentHash int64, encrypted string) {
+	request := newDeviceRequest(t, device, http.MethodPost, baseUrl+"/api/v1/feeds", fmt.Sprintf(`{"contentHash": %d, "encrypted": %q}`, contentHash, encrypted))
+	request.Header.Set("If-Match", "*")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+}
+
+func mergeInto(t *testing.T, baseUrl string, target testDevice, source testDevice) {
+	response := deviceRequest(t, target, http.MethodPost, baseUrl+"/api/v2/merge", fmt.Sprintf(`{"syncCode": %q}`, source.SyncCode))
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func getJson[T any](t *testing.T, baseUrl string, device testDevice, path string) T {
+	response := deviceRequest(t, device, http.MethodGet, baseUrl+path, "")
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var body T
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+	return body
+}
+
+func TestFeedsVersionsArePrunedAndCounted(t *testing.T) {
+	limits := server.DefaultLimits()
+	limits.MaxFeedsVersions = 2
+	limits.MaxFeedsBytes = 100
+	baseUrl := startOtherInstance(t, server.WithLimits(limits))
+
+	target := newDevice(t, baseUrl, "", "target")
+	postFeeds(t, baseUrl, target, 1, strings.Repeat("a", 10))
+
+	for i, content := range []string{"b", "c", "d"} {
+		source := newDevice(t, baseUrl, "", "source")
+		postFeeds(t, baseUrl, source, int64(i+2), strings.Repeat(content, 10))
+		mergeInto(t, baseUrl, target, source)
+	}
+
+	versions := getJson[server.FeedsVersionsResponseV2](t, baseUrl, target, "/api/v2/feeds/versions")
+	require.Len(t, versions.Versions, 2)
+
+	// Current feeds of 10 bytes, and two versions of 10 bytes each
+	usage := getJson[server.UsageResponseV2](t, baseUrl, target, "/api/v2/usage")
+	require.Equal(t, int64(30), usage.FeedsBytes.Used)
+
+	// Leaves room for a single version
+	postFeeds(t, baseUrl, target, 5, strings.Repeat("e", 85))
+
+	versions = getJson[server.FeedsVersionsResponseV2](t, baseUrl, target, "/api/v2/feeds/versions")
+	require.Len(t, versions.Versions, 1)
+
+	usage = getJson[server.UsageResponseV2](t, baseUrl, target, "/api/v2/usage")
+	require.Equal(t, int64(95), usage.FeedsBytes.Used)
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spacecowboy/feeder-sync/internal/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Runs against a database of its own, since going down drops everything the other tests use
+func TestMigrationsUpDownUp(t *testing.T) {
+	ctx := context.Background()
+	const database = "migrations_roundtrip"
+
+	pool, err := pgxpool.New(ctx, connString)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	_, err = pool.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{database}.Sanitize())
+	require.NoError(t, err)
+	defer func() {
+		_, _ = pool.Exec(ctx, "DROP DATABASE "+pgx.Identifier{database}.Sanitize()+" WITH (FORCE)")
+	}()
+
+	m, err := migrations.New(strings.Replace(connString, "/"+dbname+"?", "/"+database+"?", 1))
+	require.NoError(t, err)
+	defer m.Close()
+
+	latest, err := migrations.LatestVersion()
+	require.NoError(t, err)
+	versions, err := migrations.Versions()
+	require.NoError(t, err)
+
+	expectStatus := func(stage string, version uint, pending int) {
+		status, err := m.Status()
+		require.NoError(t, err, stage)
+		assert.Equal(t, migrations.Status{Version: version, Latest: latest, Pending: pending}, status, stage)
+	}
+
+	expectStatus("initially", 0, len(versions))
+
+	require.NoError(t, m.Up(0), "first up")
+	expectStatus("after first up", latest, 0)
+
+	// One at a time, so a failing down migration is easy to spot
+	for i := len(versions) - 1; i >= 0; i-- {
+		require.NoError(t, m.Down(1), fmt.Sprintf("down from %d", versions[i]))
+	}
+	// Nothing applied is reported as version 0
+	expectStatus("after down", 0, len(versions))
+
+	require.NoError(t, m.Up(0), "second up")
+	expectStatus("after second up", latest, 0)
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spacecowboy/feeder-sync/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func postReadMarks(t *testing.T, baseUrl string, device testDevice, identifiers ...string) int {
+	items := make([]string, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		items = append(items, fmt.Sprintf(`{"encrypted": %q}`, identifier))
+	}
+	response := deviceRequest(t, device, http.MethodPost, baseUrl+"/api/v1/ereadmark", fmt.Sprintf(`{"items": [%s]}`, strings.Join(items, ",")))
+	defer response.Body.Close()
+	return response.StatusCode
+}
+
+func TestReadMarksQuotaCountsOnlyNewReadMarks(t *testing.T) {
+	limits := server.DefaultLimits()
+	limits.MaxReadMarks = 2
+	limits.MaxIdentifierLength = 16
+	baseUrl := startOtherInstance(t, server.WithLimits(limits))
+
+	device := newDevice(t, baseUrl, "", "quota")
+
+	require.Equal(t, http.StatusNoContent, postReadMarks(t, baseUrl, device, "first", "second"))
+	// Already stored, so nothing counts against the quota
+	require.Equal(t, http.StatusNoContent, postReadMarks(t, baseUrl, device, "first", "second"))
+	require.Equal(t, http.StatusUnprocessableEntity, postReadMarks(t, baseUrl, device, "second", "third"))
+	require.Equal(t, http.StatusRequestEntityTooLarge, postReadMarks(t, baseUrl, device, strings.Repeat("x", 17)))
+}
+
+func TestDevicesQuotaHoldsForConcurrentJoins(t *testing.T) {
+	limits := server.DefaultLimits()
+	limits.MaxDevices = 3
+	baseUrl := startOtherInstance(t, server.WithLimits(limits))
+
+	creator := newDevice(t, baseUrl, "", "creator")
+
+	requests := make([]*http.Request, 0, 10)
+	for i := range 10 {
+		requests = append(requests, newDeviceRequest(t, testDevice{SyncCode: creator.SyncCode}, http.MethodPost, baseUrl+"/api/v1/join", fmt.Sprintf(`{"deviceName": "joiner %d"}`, i)))
+	}
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, len(requests))
+	for _, request := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			response.Body.Close()
+			statuses <- response.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	joined := 0
+	for status := range statuses {
+		if status == http.StatusCreated {
+			joined++
+		} else {
+			require.Equal(t, http.StatusUnprocessableEntity, status)
+		}
+	}
+	require.Equal(t, 2, joined)
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spacecowboy/feeder-sync/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func getReady(t *testing.T, baseUrl string, authorization string) (int, map[string]any) {
+	request, err := http.NewRequest(http.MethodGet, baseUrl+"/ready", nil)
+	require.NoError(t, err)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	var body map[string]any
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+	return response.StatusCode, body
+}
+
+func TestReadyShowsDetailsOnlyWithToken(t *testing.T) {
+	baseUrl := startOtherInstance(t, server.WithAdminToken("admin-secret"), server.WithMetricsToken("metrics-secret"))
+
+	for _, authorization := range []string{"", "Bearer wrong-secret"} {
+		status, body := getReady(t, baseUrl, authorization)
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, map[string]any{"status": "Ready"}, body)
+	}
+
+	for _, token := range []string{"admin-secret", "metrics-secret"} {
+		status, body := getReady(t, baseUrl, "Bearer "+token)
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "Ready", body["status"])
+		require.Contains(t, body, "database")
+		require.Contains(t, body, "pool")
+		require.Equal(t, true, body["schema"].(map[string]any)["ok"])
+	}
+}
+
+func TestReadyDependsOnSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	baseUrl := startOtherInstance(t, server.WithAdminToken("admin-secret"))
+
+	pool, err := pgxpool.New(ctx, connString)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	var version int64
+	require.NoError(t, pool.QueryRow(ctx, "SELECT version FROM schema_migrations").Scan(&version))
+	setVersion := func(version int64, dirty bool) {
+		_, err := pool.Exec(ctx, "UPDATE schema_migrations SET version = $1, dirty = $2", version, dirty)
+		require.NoError(t, err)
+	}
+	defer setVersion(version, false)
+
+	// As during a rollout, once a newer instance has migrated
+	setVersion(version+1, false)
+	status, body := getReady(t, baseUrl, "Bearer admin-secret")
+	require.Equal(t, http.StatusOK, status)
+	schema := body["schema"].(map[string]any)
+	require.Equal(t, true, schema["ok"])
+	require.NotEmpty(t, schema["warning"])
+
+	setVersion(version-1, false)
+	status, _ = getReady(t, baseUrl, "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+
+	setVersion(version, true)
+	status, body = getReady(t, baseUrl, "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, map[string]any{"status": "Not ready"}, body)
+}
@@ -0,0 +1,38 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spacecowboy/feeder-sync/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReapDevicesDeletesUsersLeftWithoutDevices(t *testing.T) {
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, connString)
+	require.NoError(t, err)
+	repo := repository.NewPostgresRepository(pool)
+	defer repo.Close(ctx)
+
+	userDevice, err := repo.RegisterNewUser(ctx, "orphaned")
+	require.NoError(t, err)
+
+	// As if an earlier reap had removed the device but not the user
+	_, err = pool.Exec(ctx, "DELETE FROM devices WHERE db_id = $1", userDevice.Device.DbID)
+	require.NoError(t, err)
+
+	// No device is old enough to be reaped
+	reaped, err := repo.ReapDevices(ctx, time.Now().Add(-time.Hour), 100)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), reaped.Devices)
+	assert.GreaterOrEqual(t, reaped.Users, int64(1))
+
+	_, err = repo.GetUserByUserId(ctx, uuid.MustParse(userDevice.User.UserID))
+	assert.ErrorIs(t, err, repository.ErrNoSuchUser)
+}